@@ -0,0 +1,37 @@
+package qtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+/* ============================ tls ========================== */
+
+// Config builds a client tls config from a CA bundle and an optional client certificate,
+// shared by the redis and elastic daos
+func Config(cafile string, certfile string, keyfile string, servername string, skipverify bool) (*tls.Config, error) {
+	var config = &tls.Config{
+		ServerName:         servername,
+		InsecureSkipVerify: skipverify,
+	}
+	if len(cafile) > 0 {
+		pem, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cafile)
+		}
+	}
+	if len(certfile) > 0 || len(keyfile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,175 @@
+package qelastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/camsiabor/qcom/qdao"
+	"github.com/camsiabor/qcom/util"
+	"github.com/olivere/elastic"
+	"net/http"
+	"time"
+)
+
+/* ============================ bulk ========================== */
+
+const DEFAULT_BULK_ACTIONS = 1000
+const DEFAULT_BULK_SIZE = 5 << 20
+const DEFAULT_BULK_RETRIES = 3
+const DEFAULT_BULK_BACKOFF = 100
+
+// bulk sends requests through _bulk in batches limited by bulk_actions and bulk_size (bytes), <= 0 for no limit,
+// items rejected with 429 are retried up to bulk_retries times with exponential backoff from bulk_backoff (ms).
+// rets[i] is the outcome of requests[i], failed items carry "error"
+func (o *DaoElastic) bulk(ctx context.Context, requests []elastic.BulkableRequest, refresh string) (rets []interface{}, err error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var maxactions = util.GetInt(o.Options, DEFAULT_BULK_ACTIONS, "bulk_actions")
+	var maxsize = util.GetInt(o.Options, DEFAULT_BULK_SIZE, "bulk_size")
+	var retries = util.GetInt(o.Options, DEFAULT_BULK_RETRIES, "bulk_retries")
+	var backoff = time.Duration(util.GetInt(o.Options, DEFAULT_BULK_BACKOFF, "bulk_backoff")) * time.Millisecond
+
+	rets = make([]interface{}, len(requests))
+	var pending = make([]int, len(requests))
+	for i := range requests {
+		pending[i] = i
+	}
+
+	for retry := 0; len(pending) > 0; retry++ {
+		if retry > 0 {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(backoff):
+			}
+			if err != nil {
+				break
+			}
+			backoff = backoff * 2
+		}
+
+		var rejected []int
+		for start := 0; start < len(pending); {
+			var end = start
+			var size = 0
+			for end < len(pending) && (maxactions <= 0 || end-start < maxactions) {
+				lines, serr := requests[pending[end]].Source()
+				if serr != nil {
+					return nil, serr
+				}
+				var linesize = 0
+				for _, line := range lines {
+					linesize += len(line) + 1
+				}
+				if maxsize > 0 && end > start && size+linesize > maxsize {
+					break
+				}
+				size += linesize
+				end++
+			}
+			var batch = pending[start:end]
+			start = end
+
+			var service = client.Bulk()
+			for _, i := range batch {
+				service = service.Add(requests[i])
+			}
+			if len(refresh) > 0 {
+				service = service.Refresh(refresh)
+			}
+			resp, berr := service.Do(ctx)
+			if berr != nil {
+				if elastic.IsStatusCode(berr, http.StatusTooManyRequests) && retry < retries {
+					rejected = append(rejected, batch...)
+					continue
+				}
+				for _, i := range batch {
+					rets[i] = map[string]interface{}{"error": berr.Error()}
+				}
+				continue
+			}
+			for n, i := range batch {
+				if n >= len(resp.Items) {
+					rets[i] = map[string]interface{}{"error": "no response item"}
+					continue
+				}
+				for _, item := range resp.Items[n] {
+					if item.Status == http.StatusTooManyRequests && retry < retries {
+						rejected = append(rejected, i)
+						break
+					}
+					rets[i] = esBulkItem(item)
+				}
+			}
+		}
+		pending = rejected
+	}
+	for _, i := range pending {
+		rets[i] = map[string]interface{}{
+			"status": http.StatusTooManyRequests,
+			"error":  err.Error(),
+		}
+	}
+
+	var failed = 0
+	for _, ret := range rets {
+		if m, ok := ret.(map[string]interface{}); ok && m["error"] != nil {
+			failed++
+		}
+	}
+	if failed > 0 && err == nil {
+		err = fmt.Errorf("bulk %d of %d items failed", failed, len(requests))
+	}
+	return rets, err
+}
+
+func esBulkItem(item *elastic.BulkResponseItem) map[string]interface{} {
+	var m = map[string]interface{}{
+		"index":  item.Index,
+		"id":     item.Id,
+		"status": item.Status,
+	}
+	if item.Error != nil {
+		m["error"] = item.Error.Type + ": " + item.Error.Reason
+		return m
+	}
+	m["result"] = item.Result
+	m["version"] = item.Version
+	m["seq_no"] = item.SeqNo
+	m["primary_term"] = item.PrimaryTerm
+	return m
+}
+
+func (o *DaoElastic) UpdateBatchContext(ctx context.Context, db string, groups []string, ids []interface{}, vals []interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
+	var idslen = len(ids)
+	var valslen = len(vals)
+	if idslen != valslen {
+		return nil, fmt.Errorf("ids len != valslen, %d != %d", idslen, valslen)
+	}
+	if len(groups) != idslen {
+		return nil, fmt.Errorf("groups len != idslen, %d != %d", len(groups), idslen)
+	}
+	var optype = "create"
+	if override {
+		optype = "index"
+	}
+	var requests = make([]elastic.BulkableRequest, idslen)
+	for i := 0; i < idslen; i++ {
+		doc, err := esDoc(vals[i], marshal)
+		if err != nil {
+			return nil, err
+		}
+		var request = elastic.NewBulkIndexRequest().
+			Index(o.getIndexName(db, groups[i])).
+			Type(DEFAULT_TYPE).
+			OpType(optype).
+			Doc(json.RawMessage(doc))
+		if sid := esId(ids[i]); len(sid) > 0 {
+			request = request.Id(sid)
+		}
+		requests[i] = request
+	}
+	return o.bulk(ctx, requests, util.GetStr(opt, "", "refresh"))
+}
@@ -0,0 +1,207 @@
+package qelastic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// esTestBulk stands in for _bulk, recording the size of every batch. ids in reject
+// are refused with 429 the first time they come
+type esTestBulk struct {
+	mutex   sync.Mutex
+	batches []int
+	bytes   []int
+	reject  map[string]bool
+}
+
+func (b *esTestBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		w.Write([]byte(`{}`))
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var items []map[string]interface{}
+	var size = 0
+	var errors = false
+	var scanner = bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		size += len(scanner.Bytes()) + 1
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for op, meta := range action {
+			if op != "delete" && scanner.Scan() {
+				size += len(scanner.Bytes()) + 1
+			}
+			var id = fmt.Sprint(meta["_id"])
+			var item = map[string]interface{}{"_index": meta["_index"], "_type": DEFAULT_TYPE, "_id": id}
+			if b.reject[id] {
+				delete(b.reject, id)
+				errors = true
+				item["status"] = http.StatusTooManyRequests
+				item["error"] = map[string]interface{}{"type": "es_rejected_execution_exception", "reason": "queue full"}
+			} else {
+				item["status"] = http.StatusCreated
+				item["result"] = "created"
+				item["_version"] = 1
+			}
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+	b.batches = append(b.batches, len(items))
+	b.bytes = append(b.bytes, size)
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": errors, "items": items})
+}
+
+// seen returns the batch sizes so far and starts over, rejecting reject
+func (b *esTestBulk) seen(reject ...string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var batches = fmt.Sprint(b.batches)
+	b.batches = nil
+	b.reject = map[string]bool{}
+	for _, id := range reject {
+		b.reject[id] = true
+	}
+	return batches
+}
+
+func esTestBulkDao(t *testing.T, server *httptest.Server, options map[string]interface{}) *DaoElastic {
+	options["urls"] = server.URL
+	options["sniff"] = false
+	options["healthcheck"] = false
+	var dao = &DaoElastic{}
+	dao.Configure("test", "elastic", "", 0, "", "", "", options)
+	if _, err := dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	return dao
+}
+
+func esTestBulkDocs(n int, pad int) (groups []string, ids []interface{}, vals []interface{}) {
+	for i := 0; i < n; i++ {
+		groups = append(groups, "g")
+		ids = append(ids, fmt.Sprint(i))
+		vals = append(vals, map[string]interface{}{"n": i, "pad": strings.Repeat("x", pad)})
+	}
+	return groups, ids, vals
+}
+
+// esTestBulkAligned checks that rets[i] reports ids[i]
+func esTestBulkAligned(t *testing.T, ret interface{}, ids []interface{}) {
+	var rets = ret.([]interface{})
+	if len(rets) != len(ids) {
+		t.Fatalf("%d rets for %d ids", len(rets), len(ids))
+	}
+	for i, one := range rets {
+		var m = one.(map[string]interface{})
+		if m["id"] != ids[i] || m["error"] != nil {
+			t.Fatalf("rets[%d] = %v, expect id %v", i, m, ids[i])
+		}
+	}
+}
+
+func TestBulkBatches(t *testing.T) {
+	var handler = &esTestBulk{}
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+	var groups, ids, vals = esTestBulkDocs(7, 10)
+
+	var dao = esTestBulkDao(t, server, map[string]interface{}{"bulk_actions": 3})
+	defer dao.Close()
+	ret, err := dao.UpdateBatchContext(context.Background(), "db", groups, ids, vals, true, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esTestBulkAligned(t, ret, ids)
+	if batches := handler.seen(); batches != "[3 3 1]" {
+		t.Fatalf("batches %s", batches)
+	}
+
+	// no action limit, everything goes at once
+	var unlimited = esTestBulkDao(t, server, map[string]interface{}{"bulk_actions": 0})
+	defer unlimited.Close()
+	if ret, err = unlimited.UpdateBatchContext(context.Background(), "db", groups, ids, vals, true, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	esTestBulkAligned(t, ret, ids)
+	if batches := handler.seen(); batches != "[7]" {
+		t.Fatalf("batches %s", batches)
+	}
+}
+
+func TestBulkSize(t *testing.T) {
+	var handler = &esTestBulk{}
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+	// two of these documents fit in a batch, three do not
+	var groups, ids, vals = esTestBulkDocs(7, 1000)
+	var dao = esTestBulkDao(t, server, map[string]interface{}{"bulk_size": 2500})
+	defer dao.Close()
+
+	ret, err := dao.UpdateBatchContext(context.Background(), "db", groups, ids, vals, true, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esTestBulkAligned(t, ret, ids)
+	handler.mutex.Lock()
+	var sizes = handler.bytes
+	handler.mutex.Unlock()
+	if batches := handler.seen(); batches != "[2 2 2 1]" {
+		t.Fatalf("batches %s", batches)
+	}
+	for _, size := range sizes {
+		if size > 2500 {
+			t.Fatalf("batch of %d bytes", size)
+		}
+	}
+}
+
+func TestBulkRetry(t *testing.T) {
+	var handler = &esTestBulk{reject: map[string]bool{"1": true, "4": true}}
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+	var groups, ids, vals = esTestBulkDocs(7, 10)
+	var dao = esTestBulkDao(t, server, map[string]interface{}{"bulk_backoff": 50})
+	defer dao.Close()
+
+	var start = time.Now()
+	ret, err := dao.UpdateBatchContext(context.Background(), "db", groups, ids, vals, true, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rejected items are retried alone, after the backoff, and land back in their place
+	esTestBulkAligned(t, ret, ids)
+	if batches := handler.seen("2"); batches != "[7 2]" {
+		t.Fatalf("batches %s", batches)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Fatalf("retried after %v, before the backoff", took)
+	}
+
+	// retries exhausted, the items keep the 429
+	var noretry = esTestBulkDao(t, server, map[string]interface{}{"bulk_retries": 0})
+	defer noretry.Close()
+	ret, err = noretry.UpdateBatchContext(context.Background(), "db", groups, ids, vals, true, 0, nil)
+	if err == nil {
+		t.Fatal("expect a failed item")
+	}
+	var failed = ret.([]interface{})[2].(map[string]interface{})
+	if failed["status"] != http.StatusTooManyRequests || failed["id"] != "2" {
+		t.Fatalf("rets[2] = %v", failed)
+	}
+}
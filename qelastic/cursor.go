@@ -0,0 +1,75 @@
+package qelastic
+
+import (
+	"fmt"
+	"github.com/camsiabor/qcom/util"
+	"time"
+)
+
+/* ============================ cursor ========================== */
+
+// cursors handed out by List / Scan start from ESCURSOR_BASE, anything below is a plain offset
+const ESCURSOR_BASE = 1 << 30
+const DEFAULT_CURSOR_TTL = 300
+
+// cursor kinds, a handle only goes on with the call that handed it out
+const (
+	esCursorSearchAfter = "search_after"
+	esCursorScroll      = "scroll"
+)
+
+type esCursor struct {
+	index    string
+	kind     string
+	sort     []interface{}
+	scrollId string
+	total    int64
+	expire   time.Time
+}
+
+func (o *DaoElastic) cursorTTL() time.Duration {
+	return time.Duration(util.GetInt(o.Options, DEFAULT_CURSOR_TTL, "cursor_ttl")) * time.Second
+}
+
+// putCursor registers c under a new handle, or under handle when it is already a cursor
+func (o *DaoElastic) putCursor(handle int, c *esCursor) int {
+	o.cmutex.Lock()
+	defer o.cmutex.Unlock()
+	var now = time.Now()
+	for h, old := range o.cursors {
+		if now.After(old.expire) {
+			delete(o.cursors, h)
+		}
+	}
+	if o.cursors == nil {
+		o.cursors = make(map[int]*esCursor)
+	}
+	if handle < ESCURSOR_BASE {
+		o.cseq++
+		handle = ESCURSOR_BASE + o.cseq
+	}
+	c.expire = now.Add(o.cursorTTL())
+	o.cursors[handle] = c
+	return handle
+}
+
+// getCursor returns the cursor of handle, refusing one handed out for another index or kind
+func (o *DaoElastic) getCursor(handle int, index string, kind string) (*esCursor, error) {
+	o.cmutex.Lock()
+	defer o.cmutex.Unlock()
+	var c = o.cursors[handle]
+	if c == nil || time.Now().After(c.expire) {
+		delete(o.cursors, handle)
+		return nil, fmt.Errorf("cursor %d unknown or expired", handle)
+	}
+	if c.index != index || c.kind != kind {
+		return nil, fmt.Errorf("cursor %d is a %s cursor of %s, not a %s cursor of %s", handle, c.kind, c.index, kind, index)
+	}
+	return c, nil
+}
+
+func (o *DaoElastic) removeCursor(handle int) {
+	o.cmutex.Lock()
+	defer o.cmutex.Unlock()
+	delete(o.cursors, handle)
+}
@@ -5,19 +5,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/camsiabor/qcom/qdao"
-	"github.com/camsiabor/qcom/qlog"
 	"github.com/camsiabor/qcom/util"
 	"github.com/olivere/elastic"
 	"github.com/pkg/errors"
-	"strconv"
+	"io"
+	"strings"
+	"sync"
 )
 
 const DEFAULT_ID = "_id"
 const DEFAULT_TYPE = "_doc"
+const DEFAULT_MAX_RESULT_WINDOW = 10000
+const DEFAULT_SCROLL_KEEP_ALIVE = "1m"
+const DEFAULT_KEYS_PAGE = 1000
+
+// ErrNotConnected is the cause (errors.Cause) of every failure to reach the cluster in the first place
+var ErrNotConnected = errors.New("elastic not connected")
 
 type DaoElastic struct {
 	qdao.Config
-	client *elastic.Client
+	client  *elastic.Client
+	cmutex  sync.Mutex
+	cseq    int
+	cursors map[int]*esCursor
 }
 
 func (o *DaoElastic) Configure(
@@ -33,38 +43,70 @@ func (o *DaoElastic) Conn() (agent interface{}, err error) {
 	if o.client != nil {
 		return o.client, nil
 	}
-	var settings = make([]elastic.ClientOptionFunc, 1)
-	var url = "http://" + o.Config.Host + ":" + strconv.Itoa(o.Config.Port)
-	settings[0] = elastic.SetURL(url)
+	client, err := o.connect()
+	if err != nil {
+		return nil, err
+	}
+	o.client = client
+	return o.client, nil
+}
+
+func (o *DaoElastic) connect() (*elastic.Client, error) {
+	httpclient, err := o.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	var settings = []elastic.ClientOptionFunc{
+		elastic.SetURL(o.urls()...),
+		elastic.SetScheme(o.scheme()),
+		elastic.SetHttpClient(httpclient),
+	}
+	settings = append(settings, o.clusterOptions()...)
 
 	if len(o.User) > 0 && len(o.Pass) > 0 {
 		settings = append(settings, elastic.SetBasicAuth(o.User, o.Pass))
 	}
-	// TODO log
-	var logger = qlog.GetLogManager().GetDef()
-	settings = append(settings, elastic.SetInfoLog(logger))
-	settings = append(settings, elastic.SetErrorLog(logger))
-	settings = append(settings, elastic.SetTraceLog(logger))
+	settings = append(settings, o.logOptions()...)
 
 	var gzip = util.GetBool(o.Options, false, "gzip")
 	settings = append(settings, elastic.SetGzip(gzip))
 
-	o.client, err = elastic.NewClient(settings...)
+	return elastic.NewClient(settings...)
+}
 
-	return o.client, err
+// getClient connects on first use, and again after Close. failures come back as ErrNotConnected
+func (o *DaoElastic) getClient() (*elastic.Client, error) {
+	o.Lock()
+	var client = o.client
+	o.UnLock()
+	if client != nil {
+		return client, nil
+	}
+	if _, err := o.Conn(); err != nil {
+		return nil, errors.Wrap(ErrNotConnected, err.Error())
+	}
+	o.Lock()
+	defer o.UnLock()
+	if o.client == nil {
+		return nil, ErrNotConnected
+	}
+	return o.client, nil
 }
 
+// Close stops the sniffer and health check of the client, closing twice is fine
 func (o *DaoElastic) Close() error {
 	o.Lock()
 	defer o.UnLock()
-	if o.client == nil {
-		return errors.New("not open yet")
+	if o.client != nil {
+		o.client.Stop()
+		o.client = nil
 	}
-	o.client = nil
 	return nil
 }
 
 func (o *DaoElastic) IsConnected() bool {
+	o.Lock()
+	defer o.UnLock()
 	if o.client == nil {
 		return false
 	}
@@ -72,7 +114,11 @@ func (o *DaoElastic) IsConnected() bool {
 }
 
 func (o *DaoElastic) Agent() (agent interface{}, err error) {
-	return o.client, nil
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 func (o *DaoElastic) getIndexName(db string, group string) string {
@@ -90,62 +136,105 @@ func (o *DaoElastic) getIndexName(db string, group string) string {
 }
 
 func (o *DaoElastic) Keys(db string, group string, wildcard string, opt qdao.QOpt) (keys []string, err error) {
-	var key = o.Framework.GetGroupKey(db, group, "")
-	if len(key) == 0 {
-		panic(fmt.Errorf("no key specify in schema %s.%s", db, group))
-	}
-	var dsl = `{
-		"_source" : [ "%s" ],
-		"query": { 	
-			"wildcard": {
-				"name": {
-					"%s": "%s"
-				}
-			}
-		}
-	}`
-	dsl = fmt.Sprintf(dsl, key, key, wildcard)
-	esindex := o.getIndexName(db, group)
-	resp, err := o.client.Search(esindex).Source(dsl).Do(context.Background())
+	return o.KeysContext(context.Background(), db, group, wildcard, opt)
+}
+
+// KeysContext returns the schema key (Framework.GetGroupKey, _id by default) of every document whose key
+// matches wildcard, paging through with search_after by option "keys_page" (default 1000) at a time
+func (o *DaoElastic) KeysContext(ctx context.Context, db string, group string, wildcard string, opt qdao.QOpt) (keys []string, err error) {
+	client, err := o.getClient()
 	if err != nil {
 		return nil, err
 	}
-	if resp.Hits.TotalHits == 0 {
-		return []string{}, nil
-	}
-	var ids = make([]string, resp.Hits.TotalHits)
-	for i, hit := range resp.Hits.Hits {
-		if key == "_id" {
-			ids[i] = hit.Id
+	var key = o.groupKey(db, group)
+	var tiebreaker = o.tiebreaker(db, group)
+	var page = util.GetInt(o.Options, DEFAULT_KEYS_PAGE, "keys_page")
+	var esindex = o.getIndexName(db, group)
+	var query = esKeysQuery(key, wildcard)
+
+	keys = []string{}
+	var after []interface{}
+	for {
+		var service = client.Search(esindex).Query(query).Size(page).Sort(key, true)
+		if tiebreaker != key {
+			service = service.Sort(tiebreaker, true)
+		}
+		if key == DEFAULT_ID {
+			service = service.FetchSource(false)
 		} else {
-			var _source map[string]interface{}
-			if err := json.Unmarshal(*hit.Source, &_source); err != nil {
-				return nil, err
+			service = service.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(key))
+		}
+		if after != nil {
+			service = service.SearchAfter(after...)
+		}
+		resp, err := service.Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var hits = resp.Hits.Hits
+		for _, hit := range hits {
+			var k = hit.Id
+			if key != DEFAULT_ID {
+				var source map[string]interface{}
+				if hit.Source != nil {
+					if err := json.Unmarshal(*hit.Source, &source); err != nil {
+						return nil, err
+					}
+				}
+				k = util.AsStr(source[key], "")
 			}
-			ids[i] = util.AsStr(_source[key], "")
+			keys = append(keys, k)
+		}
+		if len(hits) < page {
+			return keys, nil
 		}
+		after = hits[len(hits)-1].Sort
 	}
-	return ids, err
+}
 
+// esKeysQuery matches key against a * ? wildcard, with ids or prefix queries where the pattern allows
+func esKeysQuery(key string, wildcard string) elastic.Query {
+	if len(wildcard) == 0 || wildcard == "*" {
+		return elastic.NewMatchAllQuery()
+	}
+	var wild = strings.IndexAny(wildcard, "*?")
+	if wild < 0 {
+		if key == DEFAULT_ID {
+			return elastic.NewIdsQuery().Ids(wildcard)
+		}
+		return elastic.NewTermQuery(key, wildcard)
+	}
+	if wild == len(wildcard)-1 && wildcard[wild] == '*' {
+		return elastic.NewPrefixQuery(key, wildcard[:wild])
+	}
+	return elastic.NewWildcardQuery(key, wildcard)
 }
 
 func (o *DaoElastic) Exists(db string, group string, ids []interface{}) (int64, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return -1, err
+	}
 	if len(ids) == 0 {
 		return 0, nil
 	}
-	var idstr = util.SliceJoin(ids, "\"", "\",\"", "\"")
-	var dsl = `{
-		"_source" : [ "_id" ],
+	var values = make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = esId(id)
+	}
+	dsl, err := esBind(`{
+		"size" : 0,
 		"query": {
 			"ids" : {
-				"type" : "_doc",
-					"values" : %s
+				"values" : ?
 			}
 		}
-	}`
-	dsl = fmt.Sprintf(dsl, idstr)
+	}`, values)
+	if err != nil {
+		return -1, err
+	}
 	esindex := o.getIndexName(db, group)
-	resp, err := o.client.Search(esindex).Source(dsl).Do(context.Background())
+	resp, err := client.Search(esindex).Source(dsl).Do(context.Background())
 	if err != nil {
 		return -1, err
 	}
@@ -153,130 +242,612 @@ func (o *DaoElastic) Exists(db string, group string, ids []interface{}) (int64,
 }
 
 func (o *DaoElastic) Get(db string, group string, id interface{}, unmarshal int, opt qdao.QOpt) (ret interface{}, err error) {
-	var esindex = o.getIndexName(db, group)
-	var dsl = `{	
-    	"query" : {
-        	"match_phrase": {
-           		"_id": "%s"
-			}
-    	}
-	}`
-	dsl = fmt.Sprintf(dsl, id)
-	resp, err := o.client.Search(esindex).Source(dsl).Do(context.Background())
+	return o.GetContext(context.Background(), db, group, id, unmarshal, opt)
+}
+
+// GetContext reads through the document GET API, nil if not found.
+// opt "routing", "realtime" (default true), "includes" / "excludes", "stored_fields",
+// "meta" true wraps the document as {_index, _id, _version, _seq_no, _primary_term, _source, fields}
+// so that the seq_no / primary_term can be handed back to Update as if_seq_no / if_primary_term
+func (o *DaoElastic) GetContext(ctx context.Context, db string, group string, id interface{}, unmarshal int, opt qdao.QOpt) (ret interface{}, err error) {
+	client, err := o.getClient()
 	if err != nil {
 		return nil, err
 	}
-	if resp.Hits.TotalHits == 0 {
+	var service = client.Get().Index(o.getIndexName(db, group)).Type(DEFAULT_TYPE).Id(esId(id))
+	service = service.Realtime(util.GetBool(opt, true, "realtime"))
+	if routing := util.GetStr(opt, "", "routing"); len(routing) > 0 {
+		service = service.Routing(routing)
+	}
+	if fetch := esFetchSource(opt); fetch != nil {
+		service = service.FetchSourceContext(fetch)
+	}
+	if fields := esStrings(opt["stored_fields"]); len(fields) > 0 {
+		service = service.StoredFields(fields...)
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
-	if unmarshal == 0 {
-		var jstr = string(*resp.Hits.Hits[0].Source)
-		return jstr, nil
-	} else {
-		var m map[string]interface{}
-		var err = json.Unmarshal(*resp.Hits.Hits[0].Source, &m)
-		return m, err
+	if !resp.Found {
+		return nil, nil
+	}
+	source, err := esSource(resp.Source, unmarshal)
+	if err != nil {
+		return nil, err
+	}
+	if !util.GetBool(opt, false, "meta") {
+		return source, nil
+	}
+	var meta = map[string]interface{}{
+		"_index":  resp.Index,
+		"_id":     resp.Id,
+		"_source": source,
+	}
+	if resp.Version != nil {
+		meta["_version"] = *resp.Version
 	}
+	if resp.SeqNo != nil {
+		meta["_seq_no"] = *resp.SeqNo
+	}
+	if resp.PrimaryTerm != nil {
+		meta["_primary_term"] = *resp.PrimaryTerm
+	}
+	if resp.Fields != nil {
+		meta["fields"] = resp.Fields
+	}
+	return meta, nil
 }
 
 func (o *DaoElastic) Gets(db string, group string, ids []interface{}, unmarshal int, opt qdao.QOpt) (rets []interface{}, err error) {
+	return o.GetsContext(context.Background(), db, group, ids, unmarshal, opt)
+}
+
+// GetsContext fetches through _mget, rets[i] belongs to ids[i] and is nil when missing.
+// opt "compact" drops the missing ones, "includes" / "excludes" filter _source, "routing", "realtime"
+func (o *DaoElastic) GetsContext(ctx context.Context, db string, group string, ids []interface{}, unmarshal int, opt qdao.QOpt) (rets []interface{}, err error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
 	if len(ids) == 0 {
 		return nil, nil
 	}
-	var idstr = util.SliceJoin(ids, "\"", "\",\"", "\"")
-	var dsl = `{
-		"query": {
-			"ids" : {
-				"type" : "_doc",
-					"values" : %s 
-			}
+	var esindex = o.getIndexName(db, group)
+	var routing = util.GetStr(opt, "", "routing")
+	var fetch = esFetchSource(opt)
+	var items = make([]*elastic.MultiGetItem, len(ids))
+	for i, id := range ids {
+		var item = elastic.NewMultiGetItem().Index(esindex).Type(DEFAULT_TYPE).Id(esId(id))
+		if len(routing) > 0 {
+			item = item.Routing(routing)
 		}
-	}`
-	dsl = fmt.Sprintf(dsl, idstr)
-	esindex := o.getIndexName(db, group)
-	_, err = o.client.Search(esindex).Source(dsl).Do(context.Background())
+		if fetch != nil {
+			item = item.FetchSource(fetch)
+		}
+		items[i] = item
+	}
+	resp, err := client.MultiGet().Add(items...).Realtime(util.GetBool(opt, true, "realtime")).Do(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return nil, nil
+	var compact = util.GetBool(opt, false, "compact")
+	rets = make([]interface{}, 0, len(ids))
+	for i := range ids {
+		var doc *elastic.GetResult
+		if i < len(resp.Docs) {
+			doc = resp.Docs[i]
+		}
+		if doc != nil && doc.Error != nil {
+			return nil, fmt.Errorf("mget %s %s : %s %s", esindex, doc.Id, doc.Error.Type, doc.Error.Reason)
+		}
+		if doc == nil || !doc.Found {
+			if !compact {
+				rets = append(rets, nil)
+			}
+			continue
+		}
+		ret, err := esSource(doc.Source, unmarshal)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, ret)
+	}
+	return rets, nil
 }
 
 func (o *DaoElastic) List(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt) (rets []interface{}, cursor int, err error) {
-	panic("implement me")
+	return o.ListContext(context.Background(), db, group, from, size, unmarshal, opt)
 }
 
-func (o *DaoElastic) Update(db string, group string, id interface{}, val interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
-	//var esindex = o.getIndexName(db, group)
-	//if (!override) {
-	//	//o.client.Search(esindex).Query(elastic.NewTermsQuery())
-	//}
+// tiebreaker is the unique field that makes the sort order total, needed by search_after
+func (o *DaoElastic) tiebreaker(db string, group string) string {
+	if tiebreaker := util.GetStr(o.Options, "", "tiebreaker"); len(tiebreaker) > 0 {
+		return tiebreaker
+	}
+	return o.groupKey(db, group)
+}
 
-	//var updateService = o.client.Update().Index(esindex).Type(DEFAULT_TYPE).Id(id).Doc(val)
-	//updateService.DocAsUpsert(true);
-	//var resp, err = updateService.Do(context.Background())
-	//if err != nil {
-	//	return nil, err
-	//}
+func (o *DaoElastic) groupKey(db string, group string) string {
+	if o.Framework == nil {
+		return DEFAULT_ID
+	}
+	if key := o.Framework.GetGroupKey(db, group, DEFAULT_ID); len(key) > 0 {
+		return key
+	}
+	return DEFAULT_ID
+}
 
-	panic("implement me")
+// ListContext pages with from / size while within max_result_window, past it the returned cursor
+// is a handle (>= ESCURSOR_BASE) that continues with search_after. cursor -1 means done
+func (o *DaoElastic) ListContext(ctx context.Context, db string, group string, from int, size int, unmarshal int, opt qdao.QOpt) (rets []interface{}, cursor int, err error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, -1, err
+	}
+	if size <= 0 {
+		size = 1
+	}
+	var esindex = o.getIndexName(db, group)
+	var window = util.GetInt(o.Options, DEFAULT_MAX_RESULT_WINDOW, "max_result_window")
+	var service = client.Search(esindex).Size(size).Sort(o.tiebreaker(db, group), true)
+	if fetch := esFetchSource(opt); fetch != nil {
+		service = service.FetchSourceContext(fetch)
+	}
+	if routing := util.GetStr(opt, "", "routing"); len(routing) > 0 {
+		service = service.Routing(routing)
+	}
+	if from >= ESCURSOR_BASE {
+		c, err := o.getCursor(from, esindex, esCursorSearchAfter)
+		if err != nil {
+			return nil, -1, err
+		}
+		service = service.SearchAfter(c.sort...)
+	} else {
+		if from < 0 {
+			from = 0
+		}
+		if from+size > window {
+			return nil, -1, fmt.Errorf("from %d size %d exceeds max_result_window %d, page on with the returned cursor", from, size, window)
+		}
+		service = service.From(from)
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		return nil, -1, err
+	}
+	var hits = resp.Hits.Hits
+	rets = make([]interface{}, len(hits))
+	for i, hit := range hits {
+		if rets[i], err = esHit(hit, unmarshal); err != nil {
+			return nil, -1, err
+		}
+	}
+	if len(hits) < size {
+		if from >= ESCURSOR_BASE {
+			o.removeCursor(from)
+		}
+		return rets, -1, nil
+	}
+	if from < ESCURSOR_BASE && from+len(hits)+size <= window {
+		return rets, from + len(hits), nil
+	}
+	cursor = o.putCursor(from, &esCursor{index: esindex, kind: esCursorSearchAfter, sort: hits[len(hits)-1].Sort})
+	return rets, cursor, nil
+}
+
+func (o *DaoElastic) Update(db string, group string, id interface{}, val interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
+	return o.UpdateContext(context.Background(), db, group, id, val, override, marshal, opt)
+}
+
+func (o *DaoElastic) UpdateContext(ctx context.Context, db string, group string, id interface{}, val interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var esindex = o.getIndexName(db, group)
+	doc, err := esDoc(val, marshal)
+	if err != nil {
+		return nil, err
+	}
+	var sid = esId(id)
+	var service = client.Index().Index(esindex).Type(DEFAULT_TYPE).BodyString(doc)
+	if len(sid) > 0 {
+		service = service.Id(sid)
+	}
+	if override {
+		service = service.OpType("index")
+	} else {
+		service = service.OpType("create")
+	}
+	if refresh := util.GetStr(opt, "", "refresh"); len(refresh) > 0 {
+		service = service.Refresh(refresh)
+	}
+	if routing := util.GetStr(opt, "", "routing"); len(routing) > 0 {
+		service = service.Routing(routing)
+	}
+	// optimistic concurrency, values as returned by Get with opt "meta"
+	var guarded = false
+	if opt["if_seq_no"] != nil && opt["if_primary_term"] != nil {
+		service = service.IfSeqNo(int64(util.GetInt(opt, 0, "if_seq_no")))
+		service = service.IfPrimaryTerm(int64(util.GetInt(opt, 0, "if_primary_term")))
+		guarded = true
+	} else if opt["version"] != nil {
+		service = service.Version(int64(util.GetInt(opt, 0, "version")))
+		service = service.VersionType(util.GetStr(opt, "internal", "version_type"))
+		guarded = true
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		if (!override || guarded) && elastic.IsConflict(err) {
+			return map[string]interface{}{
+				"index":  esindex,
+				"id":     sid,
+				"result": "conflict",
+			}, nil
+		}
+		return nil, err
+	}
+	return map[string]interface{}{
+		"index":        resp.Index,
+		"id":           resp.Id,
+		"result":       resp.Result,
+		"version":      resp.Version,
+		"seq_no":       resp.SeqNo,
+		"primary_term": resp.PrimaryTerm,
+	}, nil
 }
 
 func (o *DaoElastic) Updates(db string, group string, ids []interface{}, vals []interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
-	panic("implement me")
+	var groups = make([]string, len(ids))
+	for i := range groups {
+		groups[i] = group
+	}
+	return o.UpdateBatch(db, groups, ids, vals, override, marshal, opt)
 }
 
 func (o *DaoElastic) UpdateBatch(db string, groups []string, ids []interface{}, vals []interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
-	panic("implement me")
+	return o.UpdateBatchContext(context.Background(), db, groups, ids, vals, override, marshal, opt)
 }
 
 func (o *DaoElastic) Delete(db string, group string, id interface{}, opt qdao.DOpt) (interface{}, error) {
-	panic("implement me")
+	return o.DeleteContext(context.Background(), db, group, id, opt)
 }
 
-func (o *DaoElastic) Deletes(db string, group string, ids []interface{}, opt qdao.DOpt) (interface{}, error) {
-	panic("implement me")
+// DeleteContext returns 1 if the document is removed, 0 if it does not exist.
+// with opt "query" it deletes by query instead, see deleteByQuery
+func (o *DaoElastic) DeleteContext(ctx context.Context, db string, group string, id interface{}, opt qdao.DOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	if query := opt["query"]; query != nil {
+		return o.deleteByQuery(ctx, db, group, query, opt)
+	}
+	var service = client.Delete().Index(o.getIndexName(db, group)).Type(DEFAULT_TYPE).Id(esId(id))
+	if refresh := util.GetStr(opt, "", "refresh"); len(refresh) > 0 {
+		service = service.Refresh(refresh)
+	}
+	if routing := util.GetStr(opt, "", "routing"); len(routing) > 0 {
+		service = service.Routing(routing)
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, nil
+		}
+		return nil, err
+	}
+	if resp.Result == "deleted" {
+		return 1, nil
+	}
+	return 0, nil
 }
 
-func (o *DaoElastic) SelectDB(db string) error {
-	return nil
+func (o *DaoElastic) Deletes(db string, group string, ids []interface{}, opt qdao.DOpt) (interface{}, error) {
+	return o.DeletesContext(context.Background(), db, group, ids, opt)
 }
 
-func (o *DaoElastic) UpdateDB(db string, options interface{}, create bool, override bool, opt qdao.UOpt) (interface{}, error) {
-	panic("implement me")
+// DeletesContext returns the count of documents actually removed
+func (o *DaoElastic) DeletesContext(ctx context.Context, db string, group string, ids []interface{}, opt qdao.DOpt) (interface{}, error) {
+	if query := opt["query"]; query != nil {
+		return o.deleteByQuery(ctx, db, group, query, opt)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	var esindex = o.getIndexName(db, group)
+	var routing = util.GetStr(opt, "", "routing")
+	var requests = make([]elastic.BulkableRequest, len(ids))
+	for i, id := range ids {
+		var request = elastic.NewBulkDeleteRequest().Index(esindex).Type(DEFAULT_TYPE).Id(esId(id))
+		if len(routing) > 0 {
+			request = request.Routing(routing)
+		}
+		requests[i] = request
+	}
+	rets, err := o.bulk(ctx, requests, util.GetStr(opt, "", "refresh"))
+	var count = 0
+	for _, ret := range rets {
+		if m, ok := ret.(map[string]interface{}); ok && m["result"] == "deleted" {
+			count++
+		}
+	}
+	return count, err
 }
 
-func (o *DaoElastic) UpdateGroup(db string, group string, options interface{}, create bool, override bool, opt qdao.UOpt) (interface{}, error) {
-	panic("implement me")
+// deleteByQuery takes the query as an elastic.Query, a json string or a map (see esQuery).
+// opt "conflicts" (abort / proceed), "refresh" (bool), "wait_for_completion" (default true),
+// without waiting it returns {"task": id} for the tasks api
+func (o *DaoElastic) deleteByQuery(ctx context.Context, db string, group string, query interface{}, opt qdao.DOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	q, body, err := esQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	var service = client.DeleteByQuery(o.getIndexName(db, group))
+	if q != nil {
+		service = service.Query(q)
+	} else {
+		service = service.Body(body)
+	}
+	if conflicts := util.GetStr(opt, "", "conflicts"); len(conflicts) > 0 {
+		service = service.Conflicts(conflicts)
+	}
+	if util.GetBool(opt, false, "refresh") {
+		service = service.Refresh("true")
+	}
+	if !util.GetBool(opt, true, "wait_for_completion") {
+		task, err := service.WaitForCompletion(false).DoAsync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"task": task.TaskId}, nil
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"total":             resp.Total,
+		"deleted":           resp.Deleted,
+		"version_conflicts": resp.VersionConflicts,
+		"failures":          len(resp.Failures),
+		"took":              resp.Took,
+	}, nil
 }
 
-func (o *DaoElastic) ExistDB(db string) (bool, error) {
-	panic("implement me")
+func (o *DaoElastic) SelectDB(db string) error {
+	return nil
 }
 
-func (o *DaoElastic) ExistGroup(db string, group string) (bool, error) {
-	panic("implement me")
+func (o *DaoElastic) Scan(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt, query ...interface{}) (ret []interface{}, cursor int, total int, err error) {
+	return o.ScanContext(context.Background(), db, group, from, size, unmarshal, opt, query...)
 }
 
-func (o *DaoElastic) GetDB(db string, opt qdao.QOpt) (interface{}, error) {
-	panic("implement me")
+// ScanContext walks the index with the scroll api. from 0 opens the scroll with query[0]
+// (json string, map or elastic.Query, match_all if absent), the cursor returned is the handle to go on with, -1 when done.
+// opt "keep_alive" (default 1m), "slice_id" / "slice_max" for sliced scroll, "includes" / "excludes"
+func (o *DaoElastic) ScanContext(ctx context.Context, db string, group string, from int, size int, unmarshal int, opt qdao.QOpt, query ...interface{}) (ret []interface{}, cursor int, total int, err error) {
+	hits, cursor, total, err := o.scroll(ctx, db, group, from, size, opt, query...)
+	if err != nil {
+		return nil, cursor, total, err
+	}
+	ret = make([]interface{}, len(hits))
+	for i, hit := range hits {
+		if ret[i], err = esHit(hit, unmarshal); err != nil {
+			return nil, cursor, total, err
+		}
+	}
+	return ret, cursor, total, nil
 }
 
-func (o *DaoElastic) GetGroup(db string, group string, opt qdao.QOpt) (interface{}, error) {
-	panic("implement me")
+func (o *DaoElastic) ScanAsMap(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt, query ...interface{}) (ret map[string]interface{}, cursor int, total int, err error) {
+	hits, cursor, total, err := o.scroll(context.Background(), db, group, from, size, opt, query...)
+	if err != nil {
+		return nil, cursor, total, err
+	}
+	ret = make(map[string]interface{}, len(hits))
+	for _, hit := range hits {
+		if ret[hit.Id], err = esSource(hit.Source, unmarshal); err != nil {
+			return nil, cursor, total, err
+		}
+	}
+	return ret, cursor, total, nil
 }
 
-func (o *DaoElastic) Query(db string, query string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
-	panic("implement me")
+func (o *DaoElastic) scroll(ctx context.Context, db string, group string, from int, size int, opt qdao.QOpt, query ...interface{}) (hits []*elastic.SearchHit, cursor int, total int, err error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	if size <= 0 {
+		size = 1
+	}
+	var esindex = o.getIndexName(db, group)
+	var keepalive = util.GetStr(opt, DEFAULT_SCROLL_KEEP_ALIVE, "keep_alive")
+	var service = client.Scroll(esindex).Size(size).KeepAlive(keepalive)
+	if from > 0 && from < ESCURSOR_BASE {
+		return nil, -1, 0, fmt.Errorf("scan from %d, a scroll starts from 0 and goes on with the returned cursor", from)
+	}
+	var c *esCursor
+	if from >= ESCURSOR_BASE {
+		if c, err = o.getCursor(from, esindex, esCursorScroll); err != nil {
+			return nil, -1, 0, err
+		}
+		service = service.ScrollId(c.scrollId)
+	} else {
+		c = &esCursor{index: esindex, kind: esCursorScroll}
+		var q elastic.Query
+		var body string
+		if len(query) > 0 {
+			q, body, err = esQuery(query[0])
+		} else {
+			q, body, err = esQuery(nil)
+		}
+		if err != nil {
+			return nil, -1, 0, err
+		}
+		var slice *elastic.SliceQuery
+		if max := util.GetInt(opt, 0, "slice_max"); max > 1 {
+			slice = elastic.NewSliceQuery().Id(util.GetInt(opt, 0, "slice_id")).Max(max)
+		}
+		if len(body) > 0 {
+			if slice == nil {
+				service = service.Body(body)
+			} else {
+				// a raw body wins over the builder, so the slice has to go into it
+				var m map[string]interface{}
+				if err = json.Unmarshal([]byte(body), &m); err != nil {
+					return nil, -1, 0, err
+				}
+				m["slice"] = map[string]interface{}{
+					"id":  util.GetInt(opt, 0, "slice_id"),
+					"max": util.GetInt(opt, 0, "slice_max"),
+				}
+				service = service.Body(m)
+			}
+		} else {
+			service = service.Query(q).Sort("_doc", true)
+			if slice != nil {
+				service = service.Slice(slice)
+			}
+			if fetch := esFetchSource(opt); fetch != nil {
+				service = service.FetchSourceContext(fetch)
+			}
+		}
+	}
+	resp, err := service.Do(ctx)
+	if err == io.EOF {
+		if from >= ESCURSOR_BASE {
+			o.removeCursor(from)
+			client.ClearScroll(c.scrollId).Do(context.Background())
+		}
+		return []*elastic.SearchHit{}, -1, int(c.total), nil
+	}
+	if err != nil {
+		return nil, -1, int(c.total), err
+	}
+	if from < ESCURSOR_BASE {
+		c.total = resp.Hits.TotalHits
+	}
+	c.scrollId = resp.ScrollId
+	hits = resp.Hits.Hits
+	if len(hits) < size {
+		if from >= ESCURSOR_BASE {
+			o.removeCursor(from)
+		}
+		client.ClearScroll(c.scrollId).Do(context.Background())
+		return hits, -1, int(c.total), nil
+	}
+	return hits, o.putCursor(from, c), int(c.total), nil
 }
 
-func (o *DaoElastic) Scan(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt, query ...interface{}) (ret []interface{}, cursor int, total int, err error) {
-	panic("implement me")
+func (o *DaoElastic) Script(db string, group string, id interface{}, script string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
+	return o.ScriptContext(context.Background(), db, group, id, script, args, opt)
 }
 
-func (o *DaoElastic) ScanAsMap(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt, query ...interface{}) (ret map[string]interface{}, cursor int, total int, err error) {
-	panic("implement me")
-}
+// ScriptContext runs a painless script, as a partial update of document id, or over the group's index
+// through update-by-query when id is nil / empty, restricted by opt "query" (see esQuery).
+// a single map arg becomes the script params, otherwise the args are in params.args.
+// opt "stored" takes script as a stored script id, "lang" (default painless), "upsert", "retry_on_conflict",
+// "routing", "refresh"; by query "conflicts" and "wait_for_completion" (default true) as for deletes
+func (o *DaoElastic) ScriptContext(ctx context.Context, db string, group string, id interface{}, script string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var s *elastic.Script
+	if util.GetBool(opt, false, "stored") {
+		s = elastic.NewScriptStored(script)
+	} else {
+		s = elastic.NewScript(script).Lang(util.GetStr(opt, "painless", "lang"))
+	}
+	if len(args) == 1 && args[0] != nil {
+		if params, ok := args[0].(map[string]interface{}); ok {
+			s = s.Params(params)
+		} else {
+			s = s.Param("args", args)
+		}
+	} else if len(args) > 0 {
+		s = s.Param("args", args)
+	}
 
-func (o *DaoElastic) Script(db string, group string, id interface{}, script string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
-	panic("implement me")
+	var esindex = o.getIndexName(db, group)
+	if sid := esId(id); len(sid) > 0 {
+		var service = client.Update().Index(esindex).Type(DEFAULT_TYPE).Id(sid).Script(s)
+		if upsert := opt["upsert"]; upsert != nil {
+			service = service.Upsert(upsert)
+		}
+		if retry := util.GetInt(opt, 0, "retry_on_conflict"); retry > 0 {
+			service = service.RetryOnConflict(retry)
+		}
+		if routing := util.GetStr(opt, "", "routing"); len(routing) > 0 {
+			service = service.Routing(routing)
+		}
+		if refresh := util.GetStr(opt, "", "refresh"); len(refresh) > 0 {
+			service = service.Refresh(refresh)
+		}
+		resp, err := service.Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"index":        resp.Index,
+			"id":           resp.Id,
+			"result":       resp.Result,
+			"version":      resp.Version,
+			"seq_no":       resp.SeqNo,
+			"primary_term": resp.PrimaryTerm,
+		}, nil
+	}
+
+	q, body, err := esQuery(opt["query"])
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		// the body form is reduced to its query clause, the script goes alongside it
+		m, err := esMap(body)
+		if err != nil {
+			return nil, err
+		}
+		clause, err := json.Marshal(m["query"])
+		if err != nil {
+			return nil, err
+		}
+		q = elastic.NewRawStringQuery(string(clause))
+	}
+	var service = client.UpdateByQuery(esindex).Script(s).Query(q)
+	if conflicts := util.GetStr(opt, "", "conflicts"); len(conflicts) > 0 {
+		service = service.Conflicts(conflicts)
+	}
+	if util.GetBool(opt, false, "refresh") {
+		service = service.Refresh("true")
+	}
+	if !util.GetBool(opt, true, "wait_for_completion") {
+		task, err := service.WaitForCompletion(false).DoAsync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"task": task.TaskId}, nil
+	}
+	resp, err := service.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"total":             resp.Total,
+		"updated":           resp.Updated,
+		"noops":             resp.Noops,
+		"version_conflicts": resp.VersionConflicts,
+		"failures":          len(resp.Failures),
+		"took":              resp.Took,
+	}, nil
 }
@@ -2,9 +2,16 @@ package qelastic
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/camsiabor/qcom/qref"
 	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -71,3 +78,601 @@ func TestElastic(t *testing.T) {
 	time.Sleep(time.Second)
 
 }
+
+func TestClose(t *testing.T) {
+	var dao = &DaoElastic{}
+	for i := 0; i < 2; i++ {
+		if err := dao.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if dao.IsConnected() {
+			t.Fatal("closed dao reports connected")
+		}
+	}
+}
+
+func TestNotConnected(t *testing.T) {
+	// nothing listens there, the startup health check fails
+	var dao = &DaoElastic{}
+	dao.Configure("test", "elastic", "", 0, "", "", "", map[string]interface{}{
+		"urls":                "http://127.0.0.1:1",
+		"healthcheck_timeout": 100,
+	})
+	defer dao.Close()
+	_, err := dao.Get("db", "g", "id", 0, nil)
+	if errors.Cause(err) != ErrNotConnected {
+		t.Fatalf("expect ErrNotConnected, got %v", err)
+	}
+	if dao.IsConnected() {
+		t.Fatal("unreachable dao reports connected")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	var dao = &DaoElastic{}
+	dao.Configure("test", "elastic", "", 0, "", "", "", map[string]interface{}{
+		"urls":        server.URL,
+		"sniff":       false,
+		"healthcheck": false,
+	})
+	defer dao.Close()
+
+	// connected on first use
+	client, err := dao.getClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dao.IsConnected() || !client.IsRunning() {
+		t.Fatal("expect a running client")
+	}
+
+	// Close stops the client, the next use connects again
+	if err = dao.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if client.IsRunning() {
+		t.Fatal("Close left the client running")
+	}
+	if dao.IsConnected() {
+		t.Fatal("closed dao reports connected")
+	}
+	again, err := dao.getClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == client || !again.IsRunning() || !dao.IsConnected() {
+		t.Fatal("expect a new running client")
+	}
+}
+
+// esTestRequest is a request seen by esTestServer, body decoded when json
+type esTestRequest struct {
+	method string
+	path   string
+	query  string
+	raw    string
+	body   map[string]interface{}
+}
+
+func (r *esTestRequest) String() string {
+	return r.method + " " + r.path
+}
+
+// esTestServer records every request and answers through answer, {} when it returns nil
+type esTestServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	seen   []*esTestRequest
+	answer func(r *esTestRequest) (int, interface{})
+}
+
+func newESTestServer(answer func(r *esTestRequest) (int, interface{})) *esTestServer {
+	var s = &esTestServer{answer: answer}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *esTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var raw, _ = ioutil.ReadAll(r.Body)
+	var req = &esTestRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, raw: string(raw)}
+	json.Unmarshal(raw, &req.body)
+	s.mutex.Lock()
+	s.seen = append(s.seen, req)
+	var answer = s.answer
+	s.mutex.Unlock()
+
+	var status, reply = http.StatusOK, interface{}(nil)
+	if answer != nil {
+		status, reply = answer(req)
+	}
+	if reply == nil {
+		reply = map[string]interface{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if s, ok := reply.(string); ok {
+		w.Write([]byte(s))
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// requests returns the requests seen so far and starts over
+func (s *esTestServer) requests() []*esTestRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var seen = s.seen
+	s.seen = nil
+	return seen
+}
+
+// esTestJSON renders v as compact json, for comparing request bodies
+func esTestJSON(v interface{}) string {
+	var bytes, _ = json.Marshal(v)
+	return string(bytes)
+}
+
+// esTestHits is a search response with one hit per id, sorted by id
+func esTestHits(index string, ids ...string) map[string]interface{} {
+	var hits = []interface{}{}
+	for _, id := range ids {
+		hits = append(hits, map[string]interface{}{
+			"_index": index, "_type": DEFAULT_TYPE, "_id": id,
+			"_source": map[string]interface{}{"name": id}, "sort": []interface{}{id},
+		})
+	}
+	return map[string]interface{}{"hits": map[string]interface{}{"total": len(ids), "hits": hits}}
+}
+
+func TestKeys(t *testing.T) {
+	var pages = [][]string{{"user1", "user2"}, {"user3"}}
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		if !strings.HasSuffix(r.path, "/_search") {
+			return http.StatusOK, nil
+		}
+		var page = pages[0]
+		if r.body["search_after"] != nil {
+			page = pages[1]
+		}
+		return http.StatusOK, esTestHits("db_g", page...)
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{"keys_page": 2})
+	defer dao.Close()
+
+	keys, err := dao.Keys("db", "g", "user*", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[user1 user2 user3]" {
+		t.Fatalf("keys %v", keys)
+	}
+	// a trailing * is a prefix query, the second page continues after the last sort value
+	var requests = server.requests()
+	if len(requests) != 2 || requests[0].path != "/db_g/_search" {
+		t.Fatalf("requests %v", requests)
+	}
+	if q := esTestJSON(requests[0].body["query"]); q != `{"prefix":{"_id":"user"}}` {
+		t.Fatalf("query %s", q)
+	}
+	if after := esTestJSON(requests[1].body["search_after"]); after != `["user2"]` {
+		t.Fatalf("search_after %s", after)
+	}
+
+	var expects = map[string]string{
+		"*":      `{"match_all":{}}`,
+		"user1":  `{"ids":{"values":["user1"]}}`,
+		"u?er*":  `{"wildcard":{"_id":{"wildcard":"u?er*"}}}`,
+		"*user1": `{"wildcard":{"_id":{"wildcard":"*user1"}}}`,
+	}
+	for wildcard, expect := range expects {
+		if _, err = dao.Keys("db", "g", wildcard, nil); err != nil {
+			t.Fatal(err)
+		}
+		if q := esTestJSON(server.requests()[0].body["query"]); q != expect {
+			t.Errorf("keys %s queried %s, expect %s", wildcard, q, expect)
+		}
+	}
+}
+
+func TestListSearchAfter(t *testing.T) {
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		if !strings.HasSuffix(r.path, "/_search") {
+			return http.StatusOK, nil
+		}
+		if r.body["search_after"] != nil {
+			return http.StatusOK, esTestHits("db_g", "e")
+		}
+		if fmt.Sprint(r.body["from"]) == "2" {
+			return http.StatusOK, esTestHits("db_g", "c", "d")
+		}
+		return http.StatusOK, esTestHits("db_g", "a", "b")
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{"max_result_window": 4})
+	defer dao.Close()
+
+	// from / size within the window, search_after past it
+	var ids []string
+	var cursors []int
+	var from = 0
+	for from >= 0 {
+		rets, cursor, err := dao.List("db", "g", from, 2, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ret := range rets {
+			ids = append(ids, ret.(map[string]interface{})["name"].(string))
+		}
+		cursors = append(cursors, cursor)
+		from = cursor
+	}
+	if fmt.Sprint(ids) != "[a b c d e]" || cursors[0] != 2 || cursors[1] < ESCURSOR_BASE || cursors[2] != -1 {
+		t.Fatalf("listed %v cursors %v", ids, cursors)
+	}
+	var requests = server.requests()
+	if after := esTestJSON(requests[2].body["search_after"]); after != `["d"]` || requests[2].body["from"] != nil {
+		t.Fatalf("third page %s", requests[2].raw)
+	}
+	// done, the handle is gone
+	if _, _, err := dao.List("db", "g", cursors[1], 2, 1, nil); err == nil {
+		t.Fatal("expect the finished cursor to be unknown")
+	}
+	if _, _, err := dao.List("db", "g", 3, 2, 1, nil); err == nil {
+		t.Fatal("expect an error paging past max_result_window")
+	}
+
+	// a handle only goes on with the index and the call it came from
+	_, cursor, err := dao.List("db", "g", 2, 2, 1, nil)
+	if err != nil || cursor < ESCURSOR_BASE {
+		t.Fatalf("cursor %d %v", cursor, err)
+	}
+	if _, _, err = dao.List("db", "other", cursor, 2, 1, nil); err == nil {
+		t.Fatal("expect the cursor of db_g refused for db_other")
+	}
+	if _, _, _, err = dao.Scan("db", "g", cursor, 2, 1, nil); err == nil {
+		t.Fatal("expect a search_after cursor refused by Scan")
+	}
+	if _, _, err = dao.List("db", "g", cursor, 2, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// esTestScroll answers a scroll over db_g in pages of ids, the scroll id sN continues with pages[N]
+func esTestScroll(pages ...[]string) func(r *esTestRequest) (int, interface{}) {
+	var total = 0
+	for _, page := range pages {
+		total += len(page)
+	}
+	return func(r *esTestRequest) (int, interface{}) {
+		var n = 0
+		switch {
+		case r.method == http.MethodDelete:
+			return http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": 1}
+		case r.path == "/_search/scroll":
+			fmt.Sscanf(fmt.Sprint(r.body["scroll_id"]), "s%d", &n)
+		case r.path != "/db_g/_search":
+			return http.StatusOK, nil
+		}
+		var hits = esTestHits("db_g", pages[n]...)
+		hits["hits"].(map[string]interface{})["total"] = total
+		hits["_scroll_id"] = fmt.Sprintf("s%d", n+1)
+		return http.StatusOK, hits
+	}
+}
+
+func TestScan(t *testing.T) {
+	var server = newESTestServer(esTestScroll([]string{"a", "b"}, []string{"c"}))
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	var ids []string
+	var from = 0
+	for from >= 0 {
+		rets, cursor, total, err := dao.Scan("db", "g", from, 2, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 {
+			t.Fatalf("total %d", total)
+		}
+		if cursor >= 0 && cursor < ESCURSOR_BASE {
+			t.Fatalf("cursor %d is no handle", cursor)
+		}
+		for _, ret := range rets {
+			ids = append(ids, ret.(map[string]interface{})["name"].(string))
+		}
+		from = cursor
+	}
+	if fmt.Sprint(ids) != "[a b c]" {
+		t.Fatalf("scanned %v", ids)
+	}
+	var requests = server.requests()
+	if fmt.Sprint(requests) != "[POST /db_g/_search POST /_search/scroll DELETE /_search/scroll/]" {
+		t.Fatalf("requests %v", requests)
+	}
+	if sort := esTestJSON(requests[0].body["sort"]); sort != `[{"_doc":{"order":"asc"}}]` {
+		t.Fatalf("sort %s", sort)
+	}
+	if requests[1].body["scroll_id"] != "s1" {
+		t.Fatalf("scroll %v", requests[1].body)
+	}
+
+	// an offset is no scroll position
+	if _, _, _, err := dao.Scan("db", "g", 2, 2, 1, nil); err == nil {
+		t.Fatal("expect an error scanning from an offset")
+	}
+	if requests = server.requests(); len(requests) != 0 {
+		t.Fatalf("scan from an offset sent %v", requests)
+	}
+}
+
+// esTestConflict refuses documents with "taken" as a version conflict
+func esTestConflict(r *esTestRequest) (int, interface{}) {
+	if r.body["taken"] != nil {
+		return http.StatusConflict, map[string]interface{}{
+			"error":  map[string]interface{}{"type": "version_conflict_engine_exception", "reason": "version conflict"},
+			"status": http.StatusConflict,
+		}
+	}
+	var parts = strings.Split(r.path, "/")
+	return http.StatusCreated, map[string]interface{}{
+		"_index": parts[1], "_type": DEFAULT_TYPE, "_id": parts[len(parts)-1],
+		"result": "created", "_version": 1, "_seq_no": 7, "_primary_term": 1,
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	var server = newESTestServer(esTestConflict)
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	ret, err := dao.Update("db", "g", "a", map[string]interface{}{"n": 1}, true, 1, map[string]interface{}{"refresh": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m = ret.(map[string]interface{})
+	if m["index"] != "db_g" || m["id"] != "a" || m["result"] != "created" || m["seq_no"] != int64(7) {
+		t.Fatalf("update %v", m)
+	}
+	var request = server.requests()[0]
+	if request.path != "/db_g/"+DEFAULT_TYPE+"/a" || !strings.Contains(request.query, "op_type=index") ||
+		!strings.Contains(request.query, "refresh=true") || request.raw != `{"n":1}` {
+		t.Fatalf("update sent %v?%s %s", request, request.query, request.raw)
+	}
+
+	// create only, an existing document is a conflict and no error
+	var taken = map[string]interface{}{"taken": true}
+	if ret, err = dao.Update("db", "g", "a", taken, false, 1, nil); err != nil || ret.(map[string]interface{})["result"] != "conflict" {
+		t.Fatalf("create %v %v", ret, err)
+	}
+	if request = server.requests()[0]; !strings.Contains(request.query, "op_type=create") {
+		t.Fatalf("create sent %s", request.query)
+	}
+
+	// guarded by seq_no, a concurrent change is a conflict
+	var guard = map[string]interface{}{"if_seq_no": 7, "if_primary_term": 1}
+	if ret, err = dao.Update("db", "g", "a", taken, true, 1, guard); err != nil || ret.(map[string]interface{})["result"] != "conflict" {
+		t.Fatalf("guarded %v %v", ret, err)
+	}
+	if request = server.requests()[0]; !strings.Contains(request.query, "if_seq_no=7") || !strings.Contains(request.query, "if_primary_term=1") {
+		t.Fatalf("guarded sent %s", request.query)
+	}
+
+	// a plain overwrite does not expect any conflict
+	if _, err = dao.Update("db", "g", "a", taken, true, 1, nil); !elastic.IsConflict(err) {
+		t.Fatalf("expect the conflict error, got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		switch {
+		case strings.HasSuffix(r.path, "/_delete_by_query"):
+			if strings.Contains(r.query, "wait_for_completion=false") {
+				return http.StatusOK, map[string]interface{}{"task": "node:1"}
+			}
+			return http.StatusOK, map[string]interface{}{"took": 3, "total": 2, "deleted": 2, "version_conflicts": 0, "failures": []interface{}{}}
+		case strings.HasSuffix(r.path, "/_bulk"):
+			var items []interface{}
+			for _, id := range []string{"a", "b"} {
+				var result, status = "deleted", http.StatusOK
+				if id == "b" {
+					result, status = "not_found", http.StatusNotFound
+				}
+				items = append(items, map[string]interface{}{"delete": map[string]interface{}{
+					"_index": "db_g", "_type": DEFAULT_TYPE, "_id": id, "result": result, "status": status,
+				}})
+			}
+			return http.StatusOK, map[string]interface{}{"took": 1, "errors": false, "items": items}
+		case strings.HasSuffix(r.path, "/missing"):
+			return http.StatusNotFound, map[string]interface{}{"_index": "db_g", "_id": "missing", "result": "not_found"}
+		}
+		return http.StatusOK, map[string]interface{}{"_index": "db_g", "_id": "a", "result": "deleted"}
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	if n, err := dao.Delete("db", "g", "a", nil); err != nil || n != 1 {
+		t.Fatalf("delete %v %v", n, err)
+	}
+	if request := server.requests()[0]; request.String() != "DELETE /db_g/"+DEFAULT_TYPE+"/a" {
+		t.Fatalf("delete sent %v", request)
+	}
+	if n, err := dao.Delete("db", "g", "missing", nil); err != nil || n != 0 {
+		t.Fatalf("delete of a missing document %v %v", n, err)
+	}
+	if n, err := dao.Deletes("db", "g", []interface{}{"a", "b"}, nil); err != nil || n != 1 {
+		t.Fatalf("deletes %v %v", n, err)
+	}
+	server.requests()
+
+	// by query, waiting for the result or handing back the task
+	var opt = map[string]interface{}{"query": `{"query":{"term":{"n":1}}}`, "conflicts": "proceed"}
+	ret, err := dao.Deletes("db", "g", nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := ret.(map[string]interface{}); m["deleted"] != int64(2) || m["failures"] != 0 {
+		t.Fatalf("delete by query %v", m)
+	}
+	var request = server.requests()[0]
+	if request.String() != "POST /db_g/_delete_by_query" || !strings.Contains(request.query, "conflicts=proceed") ||
+		esTestJSON(request.body["query"]) != `{"term":{"n":1}}` {
+		t.Fatalf("delete by query sent %v?%s %s", request, request.query, request.raw)
+	}
+	opt["wait_for_completion"] = false
+	if ret, err = dao.Delete("db", "g", nil, opt); err != nil || ret.(map[string]interface{})["task"] != "node:1" {
+		t.Fatalf("delete by query task %v %v", ret, err)
+	}
+}
+
+// esTestDocs holds the documents a and c of db_g
+var esTestDocs = map[string]string{"a": `{"n":1}`, "c": `{"n":3}`}
+
+func esTestDoc(id string) map[string]interface{} {
+	var doc = map[string]interface{}{"_index": "db_g", "_type": DEFAULT_TYPE, "_id": id, "found": false}
+	if source, ok := esTestDocs[id]; ok {
+		doc["found"] = true
+		doc["_version"] = 2
+		doc["_seq_no"] = 5
+		doc["_primary_term"] = 1
+		doc["_source"] = json.RawMessage(source)
+	}
+	return doc
+}
+
+func TestGets(t *testing.T) {
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		if r.path != "/_mget" {
+			return http.StatusOK, nil
+		}
+		var docs []interface{}
+		for _, item := range r.body["docs"].([]interface{}) {
+			docs = append(docs, esTestDoc(item.(map[string]interface{})["_id"].(string)))
+		}
+		return http.StatusOK, map[string]interface{}{"docs": docs}
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	// rets[i] belongs to ids[i], nil when missing
+	rets, err := dao.Gets("db", "g", []interface{}{"c", "b", "a"}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rets) != "[map[n:3] <nil> map[n:1]]" {
+		t.Fatalf("gets %v", rets)
+	}
+	var request = server.requests()[0]
+	if esTestJSON(request.body["docs"]) != `[{"_id":"c","_index":"db_g","_type":"_doc"},{"_id":"b","_index":"db_g","_type":"_doc"},{"_id":"a","_index":"db_g","_type":"_doc"}]` {
+		t.Fatalf("mget sent %s", request.raw)
+	}
+
+	var opt = map[string]interface{}{"compact": true, "realtime": false, "includes": []string{"n"}}
+	if rets, err = dao.Gets("db", "g", []interface{}{"c", "b", "a"}, 0, opt); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rets) != `[{"n":3} {"n":1}]` {
+		t.Fatalf("compact gets %v", rets)
+	}
+	request = server.requests()[0]
+	if !strings.Contains(request.query, "realtime=false") || !strings.Contains(request.raw, `"_source":{"includes":["n"]}`) {
+		t.Fatalf("mget sent %s %s", request.query, request.raw)
+	}
+}
+
+func TestGet(t *testing.T) {
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		var parts = strings.Split(r.path, "/")
+		var doc = esTestDoc(parts[len(parts)-1])
+		if doc["found"] == false {
+			return http.StatusNotFound, doc
+		}
+		return http.StatusOK, doc
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	ret, err := dao.Get("db", "g", "a", 1, map[string]interface{}{"routing": "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ret) != "map[n:1]" {
+		t.Fatalf("get %v", ret)
+	}
+	var request = server.requests()[0]
+	if request.String() != "GET /db_g/"+DEFAULT_TYPE+"/a" || !strings.Contains(request.query, "routing=r1") {
+		t.Fatalf("get sent %v?%s", request, request.query)
+	}
+	if ret, err = dao.Get("db", "g", "b", 1, nil); err != nil || ret != nil {
+		t.Fatalf("get of a missing document %v %v", ret, err)
+	}
+
+	// meta carries what Update needs to guard a write
+	if ret, err = dao.Get("db", "g", "a", 1, map[string]interface{}{"meta": true}); err != nil {
+		t.Fatal(err)
+	}
+	var meta = ret.(map[string]interface{})
+	if meta["_id"] != "a" || meta["_seq_no"] != int64(5) || meta["_primary_term"] != int64(1) || meta["_version"] != int64(2) {
+		t.Fatalf("get meta %v", meta)
+	}
+}
+
+func TestScript(t *testing.T) {
+	var server = newESTestServer(func(r *esTestRequest) (int, interface{}) {
+		if strings.HasSuffix(r.path, "/_update_by_query") {
+			return http.StatusOK, map[string]interface{}{"took": 2, "total": 3, "updated": 3, "noops": 0, "failures": []interface{}{}}
+		}
+		return http.StatusOK, map[string]interface{}{"_index": "db_g", "_type": DEFAULT_TYPE, "_id": "a", "result": "updated", "_version": 3}
+	})
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	// a single map is the params
+	var opt = map[string]interface{}{"upsert": map[string]interface{}{"n": 0}, "retry_on_conflict": 3}
+	ret, err := dao.Script("db", "g", "a", "ctx._source.n += params.k", []interface{}{map[string]interface{}{"k": 2}}, opt)
+	if err != nil || ret.(map[string]interface{})["result"] != "updated" {
+		t.Fatalf("script %v %v", ret, err)
+	}
+	var request = server.requests()[0]
+	if request.String() != "POST /db_g/"+DEFAULT_TYPE+"/a/_update" || !strings.Contains(request.query, "retry_on_conflict=3") {
+		t.Fatalf("script sent %v?%s", request, request.query)
+	}
+	if body := esTestJSON(request.body); body != `{"script":{"lang":"painless","params":{"k":2},"source":"ctx._source.n += params.k"},"upsert":{"n":0}}` {
+		t.Fatalf("script sent %s", body)
+	}
+
+	// other args go in params.args, a stored script by id
+	if _, err = dao.Script("db", "g", "a", "incr", []interface{}{1, "x"}, map[string]interface{}{"stored": true}); err != nil {
+		t.Fatal(err)
+	}
+	if script := esTestJSON(server.requests()[0].body["script"]); script != `{"id":"incr","params":{"args":[1,"x"]}}` {
+		t.Fatalf("stored script sent %s", script)
+	}
+
+	// without id, over the documents matching the query
+	opt = map[string]interface{}{"query": `{"query":{"term":{"n":1}}}`, "conflicts": "proceed"}
+	if ret, err = dao.Script("db", "g", nil, "ctx._source.n = 0", nil, opt); err != nil {
+		t.Fatal(err)
+	}
+	if m := ret.(map[string]interface{}); m["updated"] != int64(3) || m["failures"] != 0 {
+		t.Fatalf("script by query %v", m)
+	}
+	request = server.requests()[0]
+	if request.String() != "POST /db_g/_update_by_query" || !strings.Contains(request.query, "conflicts=proceed") ||
+		esTestJSON(request.body) != `{"query":{"term":{"n":1}},"script":{"lang":"painless","source":"ctx._source.n = 0"}}` {
+		t.Fatalf("script by query sent %v?%s %s", request, request.query, request.raw)
+	}
+}
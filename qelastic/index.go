@@ -0,0 +1,407 @@
+package qelastic
+
+import (
+	"context"
+	"fmt"
+	"github.com/camsiabor/qcom/qdao"
+	"github.com/camsiabor/qcom/util"
+	"github.com/olivere/elastic"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ============================ index ========================== */
+
+// esIndexBody picks "settings" and "mappings" out of options (map or json string).
+// mappings may come with or without the _doc type level
+func esIndexBody(options interface{}) (settings map[string]interface{}, mappings map[string]interface{}, err error) {
+	m, err := esMap(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if settings, err = esMap(m["settings"]); err != nil {
+		return nil, nil, err
+	}
+	if mappings, err = esMap(m["mappings"]); err != nil {
+		return nil, nil, err
+	}
+	if typed, ok := mappings[DEFAULT_TYPE]; ok {
+		if mappings, err = esMap(typed); err != nil {
+			return nil, nil, err
+		}
+	}
+	return settings, mappings, nil
+}
+
+func (o *DaoElastic) createIndex(ctx context.Context, name string, settings map[string]interface{}, mappings map[string]interface{}) error {
+	client, err := o.getClient()
+	if err != nil {
+		return err
+	}
+	var body = map[string]interface{}{}
+	if len(settings) > 0 {
+		body["settings"] = settings
+	}
+	if len(mappings) > 0 {
+		body["mappings"] = map[string]interface{}{DEFAULT_TYPE: mappings}
+	}
+	_, err = client.CreateIndex(name).BodyJson(body).Do(ctx)
+	return err
+}
+
+// UpdateGroup creates the index getIndexName(db, group) from options {"settings": ..., "mappings": ...},
+// or applies them to the existing one. with override the index is rebuilt instead: writes to it are blocked,
+// the data is reindexed into <name>_<timestamp> and name becomes an alias of it. when name was a concrete index
+// it is deleted by the swap, when it was already an alias the indices behind it are kept (still write blocked)
+// unless opt "remove_old"
+func (o *DaoElastic) UpdateGroup(db string, group string, options interface{}, create bool, override bool, opt qdao.UOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var ctx = context.Background()
+	var name = o.getIndexName(db, group)
+	settings, mappings, err := esIndexBody(options)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.IndexExists(name).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if !create {
+			return nil, fmt.Errorf("index %s not exists", name)
+		}
+		if err = o.createIndex(ctx, name, settings, mappings); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"index": name, "result": "created"}, nil
+	}
+	if !override {
+		if len(settings) > 0 {
+			if _, err = client.IndexPutSettings(name).BodyJson(settings).Do(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if len(mappings) > 0 {
+			if _, err = client.PutMapping().Index(name).Type(DEFAULT_TYPE).BodyJson(mappings).Do(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"index": name, "result": "updated"}, nil
+	}
+
+	aliases, err := client.Aliases().Index(name).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var olds = aliases.IndicesByAlias(name)
+	var now = time.Now()
+	var target = fmt.Sprintf("%s_%s%09d", name, now.Format("20060102150405"), now.Nanosecond())
+	if err = o.createIndex(ctx, target, settings, mappings); err != nil {
+		return nil, err
+	}
+	// documents written during the reindex would be lost with the swap
+	if err = o.blockWrite(ctx, name, true); err != nil {
+		return nil, err
+	}
+	resp, err := client.Reindex().SourceIndex(name).DestinationIndex(target).
+		Refresh("true").WaitForCompletion(true).Do(ctx)
+	if err == nil && len(resp.Failures) > 0 {
+		err = fmt.Errorf("reindex %s into %s, %d failures, %s left in place", name, target, len(resp.Failures), target)
+	}
+	if err != nil {
+		o.blockWrite(ctx, name, false)
+		return nil, err
+	}
+	var swap = client.Alias().Add(target, name)
+	if len(olds) == 0 {
+		// name is a concrete index, it has to go in the same action that makes it an alias
+		swap = swap.Action(elastic.NewAliasRemoveIndexAction(name))
+	} else {
+		for _, old := range olds {
+			swap = swap.Remove(old, name)
+		}
+	}
+	if _, err = swap.Do(ctx); err != nil {
+		o.blockWrite(ctx, name, false)
+		return nil, err
+	}
+	if len(olds) > 0 && util.GetBool(opt, false, "remove_old") {
+		if _, err = client.DeleteIndex(olds...).Do(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{
+		"index":     name,
+		"result":    "reindexed",
+		"target":    target,
+		"previous":  olds,
+		"reindexed": resp.Created + resp.Updated,
+	}, nil
+}
+
+// blockWrite sets or lifts index.blocks.write on index
+func (o *DaoElastic) blockWrite(ctx context.Context, index string, block bool) error {
+	client, err := o.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.IndexPutSettings(index).BodyJson(map[string]interface{}{"index.blocks.write": block}).Do(ctx)
+	return err
+}
+
+func (o *DaoElastic) ExistGroup(db string, group string) (bool, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return false, err
+	}
+	return client.IndexExists(o.getIndexName(db, group)).Do(context.Background())
+}
+
+// UpdateDB registers db in DBMapping with options "prefix" (default db) as the index prefix of its groups,
+// a db already mapped to another prefix is only remapped with override.
+// "settings" / "mappings" in options go into an index template <prefix>_* so that every group
+// created afterwards picks them up, override replaces an existing template
+func (o *DaoElastic) UpdateDB(db string, options interface{}, create bool, override bool, opt qdao.UOpt) (interface{}, error) {
+	m, err := esMap(options)
+	if err != nil {
+		return nil, err
+	}
+	var prefix = util.GetStr(m, db, "prefix")
+	o.Lock()
+	if o.DBMapping == nil {
+		o.DBMapping = map[string]interface{}{}
+	}
+	if mapped := o.DBMapping[db]; mapped != nil && mapped != prefix && !override {
+		o.UnLock()
+		return nil, fmt.Errorf("db %s already mapped to %v", db, mapped)
+	}
+	o.DBMapping[db] = prefix
+	o.UnLock()
+
+	var ret = map[string]interface{}{"db": db, "prefix": prefix}
+	settings, mappings, err := esIndexBody(m)
+	if err != nil {
+		return nil, err
+	}
+	if !create || (len(settings) == 0 && len(mappings) == 0) {
+		return ret, nil
+	}
+	var template = map[string]interface{}{
+		"index_patterns": []string{prefix + "_*"},
+	}
+	if len(settings) > 0 {
+		template["settings"] = settings
+	}
+	if len(mappings) > 0 {
+		template["mappings"] = map[string]interface{}{DEFAULT_TYPE: mappings}
+	}
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	_, err = client.IndexPutTemplate(prefix).BodyJson(template).Create(!override).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ret["template"] = prefix
+	return ret, nil
+}
+
+// ExistDB is true for a db registered by UpdateDB, or with indices under its prefix
+func (o *DaoElastic) ExistDB(db string) (bool, error) {
+	o.Lock()
+	var mapped = o.DBMapping[db]
+	o.UnLock()
+	if mapped != nil {
+		return true, nil
+	}
+	client, err := o.getClient()
+	if err != nil {
+		return false, err
+	}
+	return client.IndexExists(o.getIndexName(db, "") + "_*").Do(context.Background())
+}
+
+var esHealthRank = map[string]int{"green": 0, "yellow": 1, "red": 2}
+
+// describe returns, per concrete index behind pattern, its health, status, docs_count, store_size (bytes),
+// mappings and settings
+func (o *DaoElastic) describe(ctx context.Context, pattern string) (map[string]map[string]interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := client.CatIndices().Index(pattern).Bytes("b").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var infos = make(map[string]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		var size, _ = strconv.ParseInt(row.StoreSize, 10, 64)
+		infos[row.Index] = map[string]interface{}{
+			"index":      row.Index,
+			"health":     row.Health,
+			"status":     row.Status,
+			"docs_count": row.DocsCount,
+			"store_size": size,
+		}
+	}
+	if len(infos) == 0 {
+		return infos, nil
+	}
+	mappings, err := client.GetMapping().Index(pattern).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for index, mapping := range mappings {
+		if info := infos[index]; info != nil {
+			if m, ok := mapping.(map[string]interface{}); ok {
+				info["mappings"] = m["mappings"]
+			}
+		}
+	}
+	settings, err := client.IndexGetSettings(pattern).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for index, setting := range settings {
+		if info := infos[index]; info != nil && setting != nil {
+			info["settings"] = setting.Settings
+		}
+	}
+	return infos, nil
+}
+
+// GetGroup describes the index of group, see describe. when the name is an alias over
+// several indices they are listed under "indices" and the counts are summed
+func (o *DaoElastic) GetGroup(db string, group string, opt qdao.QOpt) (interface{}, error) {
+	var name = o.getIndexName(db, group)
+	infos, err := o.describe(context.Background(), name)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, nil
+	}
+	if len(infos) == 1 {
+		for _, info := range infos {
+			info["group"] = group
+			return info, nil
+		}
+	}
+	var ret = esSum(infos)
+	ret["index"] = name
+	ret["group"] = group
+	return ret, nil
+}
+
+// esPrevious matches the indices UpdateGroup reindexed into, <name>_<timestamp>
+var esPrevious = regexp.MustCompile(`^(.+)_[0-9]{14,}$`)
+
+// GetDB describes the groups under the db prefix in "groups", with totals. a group behind an alias is reported
+// once under the alias name, the indices an override left outside the alias are listed in its "previous"
+// and not counted
+func (o *DaoElastic) GetDB(db string, opt qdao.QOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var ctx = context.Background()
+	var prefix = o.getIndexName(db, "")
+	infos, err := o.describe(ctx, prefix+"_*")
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := client.Aliases().Index(prefix + "_*").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var members = make(map[string]map[string]map[string]interface{}, len(infos))
+	var aliased = make(map[string]bool)
+	var unaliased []string
+	for index, info := range infos {
+		var name = ""
+		for _, alias := range aliases.Indices[index].Aliases {
+			if strings.HasPrefix(alias.AliasName, prefix+"_") {
+				name = alias.AliasName
+				break
+			}
+		}
+		if len(name) == 0 {
+			unaliased = append(unaliased, index)
+			continue
+		}
+		aliased[name] = true
+		if members[name] == nil {
+			members[name] = make(map[string]map[string]interface{})
+		}
+		members[name][index] = info
+	}
+	var previous = make(map[string][]string)
+	for _, index := range unaliased {
+		if match := esPrevious.FindStringSubmatch(index); match != nil && aliased[match[1]] {
+			previous[match[1]] = append(previous[match[1]], index)
+			continue
+		}
+		members[index] = map[string]map[string]interface{}{index: infos[index]}
+	}
+
+	var counted = make(map[string]map[string]interface{}, len(infos))
+	var groups = make(map[string]interface{}, len(members))
+	for name, indices := range members {
+		var group = strings.TrimPrefix(name, prefix+"_")
+		var info map[string]interface{}
+		for index, one := range indices {
+			counted[index] = one
+			info = one
+		}
+		if len(indices) > 1 {
+			info = esSum(indices)
+			info["index"] = name
+		}
+		info["group"] = group
+		if olds := previous[name]; len(olds) > 0 {
+			sort.Strings(olds)
+			info["previous"] = olds
+		}
+		groups[group] = info
+	}
+	var ret = esSum(counted)
+	delete(ret, "indices")
+	ret["db"] = db
+	ret["prefix"] = prefix
+	ret["groups"] = groups
+	return ret, nil
+}
+
+// esSum totals docs_count and store_size and keeps the worst health
+func esSum(infos map[string]map[string]interface{}) map[string]interface{} {
+	var docs = 0
+	var size int64 = 0
+	var health = "green"
+	var indices = make([]interface{}, 0, len(infos))
+	for _, info := range infos {
+		docs += info["docs_count"].(int)
+		size += info["store_size"].(int64)
+		if h := util.AsStr(info["health"], ""); esHealthRank[h] > esHealthRank[health] {
+			health = h
+		}
+		indices = append(indices, info)
+	}
+	return map[string]interface{}{
+		"health":     health,
+		"docs_count": docs,
+		"store_size": size,
+		"indices":    indices,
+	}
+}
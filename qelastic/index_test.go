@@ -0,0 +1,242 @@
+package qelastic
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// esTestIndices stands in for the index apis over a set of concrete indices, none with aliases.
+// the reindex fails when failures is set
+type esTestIndices struct {
+	mutex    sync.Mutex
+	indices  map[string]bool
+	failures bool
+}
+
+func (s *esTestIndices) answer(r *esTestRequest) (int, interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var parts = strings.Split(strings.Trim(r.path, "/"), "/")
+	switch {
+	case r.method == http.MethodHead:
+		for index := range s.indices {
+			if index == parts[0] || (strings.HasSuffix(parts[0], "*") && strings.HasPrefix(index, strings.TrimSuffix(parts[0], "*"))) {
+				return http.StatusOK, ""
+			}
+		}
+		return http.StatusNotFound, ""
+	case parts[0] == "_reindex":
+		if s.failures {
+			return http.StatusOK, map[string]interface{}{"created": 1, "failures": []interface{}{map[string]interface{}{"id": "b"}}}
+		}
+		return http.StatusOK, map[string]interface{}{"created": 2, "updated": 0, "failures": []interface{}{}}
+	case len(parts) > 1 && (parts[1] == "_alias" || parts[1] == "_aliases"):
+		return http.StatusOK, map[string]interface{}{parts[0]: map[string]interface{}{"aliases": map[string]interface{}{}}}
+	case r.method == http.MethodPut && len(parts) == 1:
+		s.indices[parts[0]] = true
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+// esTestCalls renders the requests as method path, without the index names made up by UpdateGroup
+func esTestCalls(requests []*esTestRequest) string {
+	var calls []string
+	for _, r := range requests {
+		var call = r.String()
+		if m := esPrevious.FindString(strings.Split(strings.Trim(r.path, "/"), "/")[0]); len(m) > 0 {
+			call = strings.Replace(call, m, "<target>", 1)
+		}
+		calls = append(calls, call)
+	}
+	return strings.Join(calls, ", ")
+}
+
+func TestUpdateGroup(t *testing.T) {
+	var indices = &esTestIndices{indices: map[string]bool{}}
+	var server = newESTestServer(indices.answer)
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+	var options = map[string]interface{}{
+		"settings": map[string]interface{}{"number_of_replicas": 0},
+		"mappings": map[string]interface{}{"properties": map[string]interface{}{"n": map[string]interface{}{"type": "long"}}},
+	}
+
+	if _, err := dao.UpdateGroup("db", "g", options, false, false, nil); err == nil {
+		t.Fatal("expect an error updating a missing index without create")
+	}
+	server.requests()
+	ret, err := dao.UpdateGroup("db", "g", options, true, false, nil)
+	if err != nil || ret.(map[string]interface{})["result"] != "created" {
+		t.Fatalf("create %v %v", ret, err)
+	}
+	var requests = server.requests()
+	if calls := esTestCalls(requests); calls != "HEAD /db_g, PUT /db_g" {
+		t.Fatalf("create sent %s", calls)
+	}
+	if body := esTestJSON(requests[1].body); body != `{"mappings":{"_doc":{"properties":{"n":{"type":"long"}}}},"settings":{"number_of_replicas":0}}` {
+		t.Fatalf("create sent %s", body)
+	}
+
+	// existing, settings and mappings are applied in place
+	if ret, err = dao.UpdateGroup("db", "g", options, true, false, nil); err != nil || ret.(map[string]interface{})["result"] != "updated" {
+		t.Fatalf("update %v %v", ret, err)
+	}
+	if calls := esTestCalls(server.requests()); calls != "HEAD /db_g, PUT /db_g/_settings, PUT /db_g/_mapping/_doc" {
+		t.Fatalf("update sent %s", calls)
+	}
+
+	// override reindexes behind write block and swaps the concrete index for an alias
+	if ret, err = dao.UpdateGroup("db", "g", options, true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	var m = ret.(map[string]interface{})
+	if m["result"] != "reindexed" || m["reindexed"] != int64(2) || !esPrevious.MatchString(m["target"].(string)) {
+		t.Fatalf("override %v", m)
+	}
+	requests = server.requests()
+	if calls := esTestCalls(requests); calls != "HEAD /db_g, GET /db_g/_alias, PUT /<target>, PUT /db_g/_settings, POST /_reindex, POST /_aliases" {
+		t.Fatalf("override sent %s", calls)
+	}
+	if block := esTestJSON(requests[3].body); block != `{"index.blocks.write":true}` {
+		t.Fatalf("block sent %s", block)
+	}
+	var actions = esTestJSON(requests[5].body["actions"])
+	if expect := fmt.Sprintf(`[{"add":{"alias":"db_g","index":"%s"}},{"remove_index":{"index":"db_g"}}]`, m["target"]); actions != expect {
+		t.Fatalf("swap sent %s, expect %s", actions, expect)
+	}
+
+	// a failed reindex lifts the block and leaves the alias alone
+	indices.mutex.Lock()
+	indices.failures = true
+	indices.mutex.Unlock()
+	if _, err = dao.UpdateGroup("db", "g", options, true, true, nil); err == nil {
+		t.Fatal("expect the reindex failures")
+	}
+	requests = server.requests()
+	var last = requests[len(requests)-1]
+	if last.String() != "PUT /db_g/_settings" || esTestJSON(last.body) != `{"index.blocks.write":false}` {
+		t.Fatalf("after the failure sent %v %s", last, last.raw)
+	}
+}
+
+func TestUpdateDB(t *testing.T) {
+	var indices = &esTestIndices{indices: map[string]bool{"logs_2020": true}}
+	var server = newESTestServer(indices.answer)
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	var options = map[string]interface{}{"prefix": "app", "settings": map[string]interface{}{"number_of_shards": 1}}
+	ret, err := dao.UpdateDB("db", options, true, false, nil)
+	if err != nil || ret.(map[string]interface{})["template"] != "app" {
+		t.Fatalf("update db %v %v", ret, err)
+	}
+	var request = server.requests()[0]
+	if request.String() != "PUT /_template/app" || !strings.Contains(request.query, "create=true") ||
+		esTestJSON(request.body) != `{"index_patterns":["app_*"],"settings":{"number_of_shards":1}}` {
+		t.Fatalf("template sent %v?%s %s", request, request.query, request.raw)
+	}
+	if dao.getIndexName("db", "g") != "app_g" {
+		t.Fatalf("index of db g %s", dao.getIndexName("db", "g"))
+	}
+
+	// remapping needs override
+	if _, err = dao.UpdateDB("db", map[string]interface{}{"prefix": "other"}, false, false, nil); err == nil {
+		t.Fatal("expect an error remapping db")
+	}
+	if _, err = dao.UpdateDB("db", map[string]interface{}{"prefix": "other"}, false, true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// mapped, or with indices under the prefix
+	for db, expect := range map[string]bool{"db": true, "logs": true, "none": false} {
+		if exist, err := dao.ExistDB(db); err != nil || exist != expect {
+			t.Errorf("exist db %s %v %v", db, exist, err)
+		}
+	}
+}
+
+// esTestStats stands in for the cat, mapping, settings and alias apis over indices: docs count,
+// health and the alias of each
+type esTestStats map[string][3]string
+
+func (s esTestStats) answer(r *esTestRequest) (int, interface{}) {
+	var parts = strings.Split(strings.Trim(r.path, "/"), "/")
+	var pattern, api = parts[0], parts[1]
+	if pattern == "_cat" {
+		pattern = parts[2]
+	}
+	var rows []interface{}
+	var reply = map[string]interface{}{}
+	for index, stat := range s {
+		if index != pattern && !(strings.HasSuffix(pattern, "*") && strings.HasPrefix(index, strings.TrimSuffix(pattern, "*"))) {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"index": index, "health": stat[1], "status": "open", "docs.count": stat[0], "store.size": stat[0] + "00",
+		})
+		switch api {
+		case "_mapping":
+			reply[index] = map[string]interface{}{"mappings": map[string]interface{}{DEFAULT_TYPE: map[string]interface{}{}}}
+		case "_settings":
+			reply[index] = map[string]interface{}{"settings": map[string]interface{}{"index": map[string]interface{}{"number_of_shards": "1"}}}
+		case "_alias":
+			var aliases = map[string]interface{}{}
+			if len(stat[2]) > 0 {
+				aliases[stat[2]] = map[string]interface{}{}
+			}
+			reply[index] = map[string]interface{}{"aliases": aliases}
+		}
+	}
+	if parts[0] != "_cat" {
+		return http.StatusOK, reply
+	}
+	if len(rows) == 0 {
+		return http.StatusNotFound, map[string]interface{}{"error": map[string]interface{}{"type": "index_not_found_exception"}, "status": 404}
+	}
+	return http.StatusOK, rows
+}
+
+func TestGetDBAndGroup(t *testing.T) {
+	var server = newESTestServer(esTestStats{
+		"db_users_20200101000000000000001": {"10", "green", "db_users"},
+		"db_users_20190101000000000000001": {"7", "green", ""},
+		"db_logs":                          {"5", "yellow", ""},
+	}.answer)
+	defer server.Close()
+	var dao = esTestBulkDao(t, server.Server, map[string]interface{}{})
+	defer dao.Close()
+
+	ret, err := dao.GetGroup("db", "logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var group = ret.(map[string]interface{})
+	if group["group"] != "logs" || group["docs_count"] != 5 || group["store_size"] != int64(500) || group["health"] != "yellow" ||
+		group["mappings"] == nil || group["settings"] == nil {
+		t.Fatalf("group %v", group)
+	}
+	if ret, err = dao.GetGroup("db", "none", nil); err != nil || ret != nil {
+		t.Fatalf("missing group %v %v", ret, err)
+	}
+
+	// the old index an override left behind is listed, not counted
+	if ret, err = dao.GetDB("db", nil); err != nil {
+		t.Fatal(err)
+	}
+	var info = ret.(map[string]interface{})
+	if info["prefix"] != "db" || info["docs_count"] != 15 || info["store_size"] != int64(1500) || info["health"] != "yellow" {
+		t.Fatalf("db %v", info)
+	}
+	var users = info["groups"].(map[string]interface{})["users"].(map[string]interface{})
+	if users["docs_count"] != 10 || fmt.Sprint(users["previous"]) != "[db_users_20190101000000000000001]" {
+		t.Fatalf("users %v", users)
+	}
+	if len(info["groups"].(map[string]interface{})) != 2 {
+		t.Fatalf("groups %v", info["groups"])
+	}
+}
@@ -0,0 +1,67 @@
+package qelastic
+
+import (
+	"fmt"
+	"github.com/camsiabor/qcom/qlog"
+	"github.com/camsiabor/qcom/util"
+	"github.com/olivere/elastic"
+	"regexp"
+	"time"
+)
+
+/* ============================ log ========================== */
+
+var esRedactions = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(?i)((?:authorization|x-api-key|cookie|set-cookie)\s*:\s*)[^\r\n]*`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)("(?:password|passwd|pass|secret|token|api_key|apikey|access_key|secret_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`), `${1}"[REDACTED]"`},
+	{regexp.MustCompile(`(://)[^/@\s:]+:[^/@\s]+@`), "${1}[REDACTED]@"},
+}
+
+// esRedact masks auth headers, credential looking json fields and user:pass in urls
+func esRedact(s string) string {
+	for _, r := range esRedactions {
+		s = r.pattern.ReplaceAllString(s, r.replace)
+	}
+	return s
+}
+
+type esRedactLogger struct {
+	logger elastic.Logger
+}
+
+func (l *esRedactLogger) Printf(format string, v ...interface{}) {
+	l.logger.Printf("%s", esRedact(fmt.Sprintf(format, v...)))
+}
+
+func (o *DaoElastic) logger() elastic.Logger {
+	var logger elastic.Logger = qlog.GetLogManager().GetDef()
+	if util.GetBool(o.Options, true, "log_redact") {
+		logger = &esRedactLogger{logger: logger}
+	}
+	return logger
+}
+
+// logOptions picks the client log channels by option "log_error" (default true), "log_info" and "log_trace",
+// the trace channel dumps whole requests and responses. everything goes through esRedact unless "log_redact" is false
+func (o *DaoElastic) logOptions() []elastic.ClientOptionFunc {
+	var settings []elastic.ClientOptionFunc
+	var logger = o.logger()
+	if util.GetBool(o.Options, true, "log_error") {
+		settings = append(settings, elastic.SetErrorLog(logger))
+	}
+	if util.GetBool(o.Options, false, "log_info") {
+		settings = append(settings, elastic.SetInfoLog(logger))
+	}
+	if util.GetBool(o.Options, false, "log_trace") {
+		settings = append(settings, elastic.SetTraceLog(logger))
+	}
+	return settings
+}
+
+// slowLog is the threshold of option "slow_log" (ms) above which requests are logged, 0 for none
+func (o *DaoElastic) slowLog() time.Duration {
+	return time.Duration(util.GetInt(o.Options, 0, "slow_log")) * time.Millisecond
+}
@@ -0,0 +1,137 @@
+package qelastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/camsiabor/qcom/qdao"
+	"github.com/camsiabor/qcom/util"
+	"github.com/olivere/elastic"
+	"net/url"
+	"strings"
+)
+
+/* ============================ query ========================== */
+
+// esBind replaces every bare ? outside json strings in dsl with the json encoding of the next arg,
+// so {"term": {"name": ?}} with "a\"b" gives {"term": {"name": "a\"b"}}
+func esBind(dsl string, args ...interface{}) (string, error) {
+	var buf strings.Builder
+	var n = 0
+	var instr = false
+	for i := 0; i < len(dsl); i++ {
+		var c = dsl[i]
+		switch {
+		case instr && c == '\\':
+			buf.WriteByte(c)
+			if i+1 < len(dsl) {
+				i++
+				buf.WriteByte(dsl[i])
+			}
+			continue
+		case c == '"':
+			instr = !instr
+		case !instr && c == '?':
+			if n >= len(args) {
+				return "", fmt.Errorf("placeholder %d without arg in %s", n+1, dsl)
+			}
+			bytes, err := json.Marshal(args[n])
+			if err != nil {
+				return "", err
+			}
+			buf.Write(bytes)
+			n++
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	if n != len(args) {
+		return "", fmt.Errorf("%d placeholders for %d args in %s", n, len(args), dsl)
+	}
+	return buf.String(), nil
+}
+
+// Query runs a raw search DSL with ? placeholders bound to args (see esBind) against opt "group",
+// or every group of db when absent. opt "template" runs a stored search template instead,
+// query being the template id (or an inline mustache source) and args[0] the params map.
+// returns {"total", "hits", "aggregations", "took"}, hits decoded into maps that carry "id"
+func (o *DaoElastic) Query(db string, query string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
+	return o.QueryContext(context.Background(), db, query, args, opt)
+}
+
+func (o *DaoElastic) QueryContext(ctx context.Context, db string, query string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
+	client, err := o.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var group = util.GetStr(opt, "", "group")
+	var esindex = o.getIndexName(db, group)
+	if len(group) == 0 && len(esindex) > 0 {
+		esindex = esindex + "_*"
+	}
+	var resp = new(elastic.SearchResult)
+	if util.GetBool(opt, false, "template") {
+		var body = map[string]interface{}{}
+		if strings.HasPrefix(strings.TrimSpace(query), "{") {
+			body["source"] = query
+		} else {
+			body["id"] = query
+		}
+		if len(args) > 0 {
+			body["params"] = args[0]
+		}
+		var path = "/_search/template"
+		if len(esindex) > 0 {
+			path = "/" + url.PathEscape(esindex) + path
+		}
+		raw, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   path,
+			Body:   body,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(raw.Body, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		dsl, err := esBind(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = client.Search(esindex).Source(dsl).Do(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var ret = map[string]interface{}{
+		"took": resp.TookInMillis,
+	}
+	var hits = []interface{}{}
+	if resp.Hits != nil {
+		ret["total"] = resp.Hits.TotalHits
+		for _, hit := range resp.Hits.Hits {
+			m, err := esHit(hit, 1)
+			if err != nil {
+				return nil, err
+			}
+			hits = append(hits, m)
+		}
+	}
+	ret["hits"] = hits
+	if len(resp.Aggregations) > 0 {
+		var aggs = make(map[string]interface{}, len(resp.Aggregations))
+		for name, raw := range resp.Aggregations {
+			var agg interface{}
+			if raw != nil {
+				if err := json.Unmarshal(*raw, &agg); err != nil {
+					return nil, err
+				}
+			}
+			aggs[name] = agg
+		}
+		ret["aggregations"] = aggs
+	}
+	return ret, nil
+}
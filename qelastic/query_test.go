@@ -0,0 +1,34 @@
+package qelastic
+
+import (
+	"testing"
+)
+
+func TestESBind(t *testing.T) {
+	var cases = []struct {
+		dsl  string
+		args []interface{}
+		want string
+	}{
+		{`{"term": {"name": ?}}`, []interface{}{`a"b`}, `{"term": {"name": "a\"b"}}`},
+		{`{"range": {"age": {"gte": ?, "lt": ?}}}`, []interface{}{18, 30.5}, `{"range": {"age": {"gte": 18, "lt": 30.5}}}`},
+		{`{"match": {"q": "why?"}, "size": ?}`, []interface{}{10}, `{"match": {"q": "why?"}, "size": 10}`},
+		{`{"match": {"q": "say \"?\""}, "ids": ?}`, []interface{}{[]string{"1", "2"}}, `{"match": {"q": "say \"?\""}, "ids": ["1","2"]}`},
+		{`{"term": {"tag": ?}}`, []interface{}{nil}, `{"term": {"tag": null}}`},
+	}
+	for _, c := range cases {
+		got, err := esBind(c.dsl, c.args...)
+		if err != nil {
+			t.Fatalf("%s : %v", c.dsl, err)
+		}
+		if got != c.want {
+			t.Fatalf("%s\n got %s\nwant %s", c.dsl, got, c.want)
+		}
+	}
+	if _, err := esBind(`{"size": ?}`); err == nil {
+		t.Fatal("expect error on missing arg")
+	}
+	if _, err := esBind(`{"size": 1}`, 1); err == nil {
+		t.Fatal("expect error on extra arg")
+	}
+}
@@ -0,0 +1,223 @@
+package qelastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/camsiabor/qcom/util"
+	"github.com/camsiabor/qdaobundle/internal/qtls"
+	"github.com/olivere/elastic"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ============================ transport ========================== */
+
+const DEFAULT_RETRY_BACKOFF_MIN = 100
+const DEFAULT_RETRY_BACKOFF_MAX = 8000
+
+// esTransport stamps the auth header on every request and puts the path prefix of a proxied cluster in front.
+// responses with a status in statuses are retried up to retries times, waiting as backoff says
+type esTransport struct {
+	base     http.RoundTripper
+	header   http.Header
+	prefix   string
+	retries  int
+	statuses map[int]bool
+	backoff  elastic.Backoff
+	slow     time.Duration
+	logger   elastic.Logger
+}
+
+func (t *esTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var r = *req
+	var u = *req.URL
+	r.URL = &u
+	r.Header = make(http.Header, len(req.Header)+len(t.header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for k, v := range t.header {
+		r.Header[k] = v
+	}
+	if len(t.prefix) > 0 {
+		u.Path = t.prefix + u.Path
+		if len(u.RawPath) > 0 {
+			u.RawPath = t.prefix + u.RawPath
+		}
+	}
+	if t.slow > 0 {
+		var start = time.Now()
+		defer func() {
+			if took := time.Since(start); took > t.slow {
+				t.logger.Printf("elastic slow request %s %s took %v", req.Method, u.RequestURI(), took)
+			}
+		}()
+	}
+	if t.retries <= 0 || len(t.statuses) == 0 {
+		return t.base.RoundTrip(&r)
+	}
+
+	// the body has to be replayable for the retries
+	if r.Body != nil && r.GetBody == nil {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		r.Body, _ = r.GetBody()
+	}
+	for retry := 1; ; retry++ {
+		resp, err := t.base.RoundTrip(&r)
+		if err != nil || !t.statuses[resp.StatusCode] || retry > t.retries {
+			return resp, err
+		}
+		wait, ok := t.backoff.Next(retry)
+		if !ok {
+			return resp, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// esRetrier retries failed connections up to retries times, waiting as backoff says
+type esRetrier struct {
+	retries int
+	backoff elastic.Backoff
+}
+
+func (r *esRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.retries {
+		return 0, false, nil
+	}
+	wait, ok := r.backoff.Next(retry)
+	return wait, ok, nil
+}
+
+// scheme is "https" with option "tls", or option "scheme"
+func (o *DaoElastic) scheme() string {
+	if util.GetBool(o.Options, false, "tls") {
+		return "https"
+	}
+	return util.GetStr(o.Options, "http", "scheme")
+}
+
+// urls are the seed urls of option "urls" (comma separated or a list), Host:Port by default
+func (o *DaoElastic) urls() []string {
+	var urls = esStrings(o.Options["urls"])
+	if len(urls) == 0 {
+		urls = []string{fmt.Sprintf("%s://%s:%d", o.scheme(), o.Host, o.Port)}
+	}
+	return urls
+}
+
+// httpClient carries the tls options (tls_ca, tls_cert, tls_key, tls_server_name, tls_skip_verify, as for redis),
+// the authorization of option "api_key" ("id:key" or already encoded) or "bearer_token", and option "path_prefix"
+func (o *DaoElastic) httpClient() (*http.Client, error) {
+	config, err := qtls.Config(
+		util.GetStr(o.Options, "", "tls_ca"),
+		util.GetStr(o.Options, "", "tls_cert"),
+		util.GetStr(o.Options, "", "tls_key"),
+		util.GetStr(o.Options, "", "tls_server_name"),
+		util.GetBool(o.Options, false, "tls_skip_verify"))
+	if err != nil {
+		return nil, err
+	}
+	var transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     config,
+		MaxIdleConnsPerHost: o.MaxIdle,
+		IdleConnTimeout:     time.Duration(o.IdleTimeout) * time.Second,
+	}
+
+	var header = http.Header{}
+	if apikey := util.GetStr(o.Options, "", "api_key"); len(apikey) > 0 {
+		if strings.Contains(apikey, ":") {
+			apikey = base64.StdEncoding.EncodeToString([]byte(apikey))
+		}
+		header.Set("Authorization", "ApiKey "+apikey)
+	} else if token := util.GetStr(o.Options, "", "bearer_token"); len(token) > 0 {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	var prefix = strings.TrimRight(util.GetStr(o.Options, "", "path_prefix"), "/")
+	if len(prefix) > 0 && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	var statuses = map[int]bool{}
+	for _, status := range esStrings(o.Options["retry_status"]) {
+		if code, err := strconv.Atoi(status); err == nil {
+			statuses[code] = true
+		}
+	}
+	return &http.Client{
+		Timeout: time.Duration(util.GetInt(o.Options, 0, "timeout")) * time.Millisecond,
+		Transport: &esTransport{
+			base:     transport,
+			header:   header,
+			prefix:   prefix,
+			retries:  util.GetInt(o.Options, 0, "retries"),
+			statuses: statuses,
+			backoff:  o.backoff(),
+			slow:     o.slowLog(),
+			logger:   o.logger(),
+		},
+	}, nil
+}
+
+func (o *DaoElastic) backoff() elastic.Backoff {
+	return elastic.NewExponentialBackoff(
+		time.Duration(util.GetInt(o.Options, DEFAULT_RETRY_BACKOFF_MIN, "retry_backoff_min"))*time.Millisecond,
+		time.Duration(util.GetInt(o.Options, DEFAULT_RETRY_BACKOFF_MAX, "retry_backoff_max"))*time.Millisecond)
+}
+
+// clusterOptions covers sniffing ("sniff", "sniff_interval", "sniff_timeout"), health checks ("healthcheck",
+// "healthcheck_interval", "healthcheck_timeout") and retries of failed connections ("retries" with
+// "retry_backoff_min" / "retry_backoff_max"), intervals and timeouts in ms. statuses to retry are in "retry_status"
+// and "timeout" bounds every request, see httpClient
+func (o *DaoElastic) clusterOptions() []elastic.ClientOptionFunc {
+	var settings []elastic.ClientOptionFunc
+	// sniffed node addresses know nothing of a proxy in between
+	var sniff = util.GetBool(o.Options, true, "sniff") && len(util.GetStr(o.Options, "", "path_prefix")) == 0
+	settings = append(settings, elastic.SetSniff(sniff))
+	if interval := util.GetInt(o.Options, 0, "sniff_interval"); interval > 0 {
+		settings = append(settings, elastic.SetSnifferInterval(time.Duration(interval)*time.Millisecond))
+	}
+	if timeout := util.GetInt(o.Options, 0, "sniff_timeout"); timeout > 0 {
+		settings = append(settings, elastic.SetSnifferTimeout(time.Duration(timeout)*time.Millisecond))
+		settings = append(settings, elastic.SetSnifferTimeoutStartup(time.Duration(timeout)*time.Millisecond))
+	}
+
+	settings = append(settings, elastic.SetHealthcheck(util.GetBool(o.Options, true, "healthcheck")))
+	if interval := util.GetInt(o.Options, 0, "healthcheck_interval"); interval > 0 {
+		settings = append(settings, elastic.SetHealthcheckInterval(time.Duration(interval)*time.Millisecond))
+	}
+	if timeout := util.GetInt(o.Options, 0, "healthcheck_timeout"); timeout > 0 {
+		settings = append(settings, elastic.SetHealthcheckTimeout(time.Duration(timeout)*time.Millisecond))
+		settings = append(settings, elastic.SetHealthcheckTimeoutStartup(time.Duration(timeout)*time.Millisecond))
+	}
+
+	if retries := util.GetInt(o.Options, 0, "retries"); retries > 0 {
+		settings = append(settings, elastic.SetRetrier(&esRetrier{retries: retries, backoff: o.backoff()}))
+	}
+	return settings
+}
@@ -0,0 +1,137 @@
+package qelastic
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	var path, auth string
+	var server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"green"}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "qelastic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var cafile = filepath.Join(dir, "ca.pem")
+	var capem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = ioutil.WriteFile(cafile, capem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var dao = &DaoElastic{}
+	dao.Configure("test", "elastic", "", 0, "", "", "", map[string]interface{}{
+		"urls":        server.URL,
+		"tls":         true,
+		"tls_ca":      cafile,
+		"api_key":     "id:secret",
+		"path_prefix": "es/",
+	})
+	if urls := dao.urls(); len(urls) != 1 || urls[0] != server.URL {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+	client, err := dao.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL + "/_cluster/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if path != "/es/_cluster/health" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	if want := "ApiKey " + base64.StdEncoding.EncodeToString([]byte("id:secret")); auth != want {
+		t.Fatalf("unexpected authorization %s", auth)
+	}
+
+	// bearer token, and the server certificate is not trusted without the CA
+	var other = &DaoElastic{}
+	other.Configure("test", "elastic", "localhost", 9200, "", "", "", map[string]interface{}{
+		"scheme":       "https",
+		"bearer_token": "token",
+	})
+	if urls := other.urls(); urls[0] != "https://localhost:9200" {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+	client, err = other.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(server.URL + "/"); err == nil {
+		t.Fatal("expect certificate verification failure")
+	}
+	if client.Transport.(*esTransport).header.Get("Authorization") != "Bearer token" {
+		t.Fatal("bearer token not set")
+	}
+}
+
+type fixedBackoff time.Duration
+
+func (b fixedBackoff) Next(retry int) (time.Duration, bool) {
+	return time.Duration(b), true
+}
+
+func TestTransportRetry(t *testing.T) {
+	var calls int
+	var bodies []string
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var client = &http.Client{Transport: &esTransport{
+		base:     http.DefaultTransport,
+		retries:  2,
+		statuses: map[int]bool{http.StatusServiceUnavailable: true},
+		backoff:  fixedBackoff(time.Millisecond),
+	}}
+	resp, err := client.Post(server.URL+"/_search", "application/json", strings.NewReader(`{"size":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Fatalf("status %d after %d calls", resp.StatusCode, calls)
+	}
+	for _, body := range bodies {
+		if body != `{"size":1}` {
+			t.Fatalf("body not replayed, %v", bodies)
+		}
+	}
+
+	// out of retries the last response is handed back
+	calls = 0
+	client.Transport.(*esTransport).retries = 1
+	resp, err = client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls != 2 {
+		t.Fatalf("status %d after %d calls", resp.StatusCode, calls)
+	}
+}
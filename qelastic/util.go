@@ -0,0 +1,174 @@
+package qelastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/camsiabor/qcom/qref"
+	"github.com/olivere/elastic"
+	"strings"
+)
+
+/* ============================ supplement ========================== */
+
+func esId(id interface{}) string {
+	switch v := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(id)
+}
+
+// esDoc serializes val into a json document as DaoRedis.Update does: marshal < 0 goes through
+// qref.MarshalLazy, marshal > 0 json encodes val whatever it is. with 0 strings are taken as
+// already serialized json and anything else is json encoded, as elasticsearch only accepts json objects
+func esDoc(val interface{}, marshal int) (string, error) {
+	if marshal < 0 {
+		return qref.MarshalLazy(val)
+	}
+	if marshal == 0 {
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			return string(v), nil
+		case json.RawMessage:
+			return string(v), nil
+		}
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// esQuery accepts an elastic.Query, a json string or a map. a json with a top-level "query"
+// is a whole request body and comes back as body, anything else is taken as the query clause itself
+func esQuery(query interface{}) (q elastic.Query, body string, err error) {
+	switch v := query.(type) {
+	case nil:
+		return elastic.NewMatchAllQuery(), "", nil
+	case elastic.Query:
+		return v, "", nil
+	case string:
+		body = strings.TrimSpace(v)
+	case []byte:
+		body = strings.TrimSpace(string(v))
+	default:
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		body = string(bytes)
+	}
+	if len(body) == 0 {
+		return elastic.NewMatchAllQuery(), "", nil
+	}
+	var m map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(body), &m); err != nil {
+		return nil, "", fmt.Errorf("invalid query %s : %v", body, err)
+	}
+	if _, ok := m["query"]; ok {
+		return nil, body, nil
+	}
+	return elastic.NewRawStringQuery(body), "", nil
+}
+
+func esStrings(v interface{}) []string {
+	switch vals := v.(type) {
+	case nil:
+		return nil
+	case string:
+		var strs []string
+		for _, one := range strings.Split(vals, ",") {
+			if one = strings.TrimSpace(one); len(one) > 0 {
+				strs = append(strs, one)
+			}
+		}
+		return strs
+	case []string:
+		return vals
+	case []interface{}:
+		var strs = make([]string, len(vals))
+		for i, val := range vals {
+			strs[i] = fmt.Sprint(val)
+		}
+		return strs
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// esFetchSource builds the _source filter from opt "includes" / "excludes", nil when neither is set
+func esFetchSource(opt map[string]interface{}) *elastic.FetchSourceContext {
+	var includes = esStrings(opt["includes"])
+	var excludes = esStrings(opt["excludes"])
+	if len(includes) == 0 && len(excludes) == 0 {
+		return nil
+	}
+	return elastic.NewFetchSourceContext(true).Include(includes...).Exclude(excludes...)
+}
+
+// esSource returns the _source as json string when unmarshal is 0, as map otherwise
+func esSource(source *json.RawMessage, unmarshal int) (interface{}, error) {
+	if source == nil {
+		return nil, nil
+	}
+	if unmarshal == 0 {
+		return string(*source), nil
+	}
+	var m map[string]interface{}
+	var err = json.Unmarshal(*source, &m)
+	return m, err
+}
+
+// esHit is the _source of hit, as map it carries the document _id as "id"
+func esHit(hit *elastic.SearchHit, unmarshal int) (interface{}, error) {
+	if hit.Source == nil {
+		if unmarshal == 0 {
+			return "", nil
+		}
+		return map[string]interface{}{"id": hit.Id}, nil
+	}
+	ret, err := esSource(hit.Source, unmarshal)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := ret.(map[string]interface{}); ok {
+		if m == nil {
+			m = map[string]interface{}{}
+		}
+		m["id"] = hit.Id
+		return m, nil
+	}
+	return ret, nil
+}
+
+// esMap takes a map, a json object string or anything that marshals into a json object
+func esMap(v interface{}) (m map[string]interface{}, err error) {
+	var bytes []byte
+	switch val := v.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return val, nil
+	case string:
+		bytes = []byte(val)
+	case []byte:
+		bytes = val
+	case json.RawMessage:
+		bytes = val
+	default:
+		if bytes, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	err = json.Unmarshal(bytes, &m)
+	return m, err
+}
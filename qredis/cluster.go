@@ -0,0 +1,672 @@
+package qredis
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ============================ cluster ========================== */
+
+const RCLUSTER_SLOTS = 16384
+const RCLUSTER_REDIRECTS = 5
+
+type RCluster struct {
+	Seeds []string
+
+	mutex   sync.RWMutex
+	slots   []string
+	pools   map[string]*redis.Pool
+	newPool func(addr string) *redis.Pool
+}
+
+func NewRCluster(seeds []string, newPool func(addr string) *redis.Pool) *RCluster {
+	return &RCluster{
+		Seeds:   seeds,
+		slots:   make([]string, RCLUSTER_SLOTS),
+		pools:   make(map[string]*redis.Pool),
+		newPool: newPool,
+	}
+}
+
+// RSlot computes the cluster slot of a key, honoring {hash tags}
+func RSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for n := 0; n < 8; n++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc = crc << 1
+			}
+		}
+	}
+	return int(crc) % RCLUSTER_SLOTS
+}
+
+func (o *RCluster) pool(addr string) *redis.Pool {
+	o.mutex.RLock()
+	var p = o.pools[addr]
+	o.mutex.RUnlock()
+	if p != nil {
+		return p
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if p = o.pools[addr]; p == nil {
+		p = o.newPool(addr)
+		o.pools[addr] = p
+	}
+	return p
+}
+
+// Refresh reloads the slot map with CLUSTER SLOTS from any reachable node
+func (o *RCluster) Refresh() error {
+	o.mutex.RLock()
+	var addrs = append([]string(nil), o.Seeds...)
+	for addr := range o.pools {
+		addrs = append(addrs, addr)
+	}
+	o.mutex.RUnlock()
+
+	var lasterr = errors.New("no cluster node configured")
+	for _, addr := range addrs {
+		var conn = o.pool(addr).Get()
+		var reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		var slots = make([]string, RCLUSTER_SLOTS)
+		for _, one := range reply {
+			var ranges, rerr = redis.Values(one, nil)
+			if rerr != nil || len(ranges) < 3 {
+				continue
+			}
+			var start, _ = redis.Int(ranges[0], nil)
+			var end, _ = redis.Int(ranges[1], nil)
+			var node, _ = redis.Values(ranges[2], nil)
+			if len(node) < 2 || start < 0 || end >= RCLUSTER_SLOTS {
+				continue
+			}
+			var host, _ = redis.String(node[0], nil)
+			var port, _ = redis.Int(node[1], nil)
+			if len(host) == 0 {
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			var master = net.JoinHostPort(host, strconv.Itoa(port))
+			for slot := start; slot <= end; slot++ {
+				slots[slot] = master
+			}
+		}
+		o.mutex.Lock()
+		o.slots = slots
+		o.mutex.Unlock()
+		return nil
+	}
+	return lasterr
+}
+
+func (o *RCluster) addr(slot int) (string, error) {
+	o.mutex.RLock()
+	var addr = o.slots[slot]
+	o.mutex.RUnlock()
+	if len(addr) > 0 {
+		return addr, nil
+	}
+	if err := o.Refresh(); err != nil {
+		return "", err
+	}
+	o.mutex.RLock()
+	addr = o.slots[slot]
+	o.mutex.RUnlock()
+	if len(addr) == 0 {
+		return "", fmt.Errorf("slot %d is not served by any node", slot)
+	}
+	return addr, nil
+}
+
+// anyAddr picks a node for keyless commands
+func (o *RCluster) anyAddr() (string, error) {
+	return o.addr(0)
+}
+
+// masters lists the nodes serving slots, in a stable order
+func (o *RCluster) masters() ([]string, error) {
+	var addrs = o.slotOwners()
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err := o.Refresh(); err != nil {
+		return nil, err
+	}
+	if addrs = o.slotOwners(); len(addrs) == 0 {
+		return nil, errors.New("no cluster node serves any slot")
+	}
+	return addrs, nil
+}
+
+func (o *RCluster) slotOwners() []string {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	var seen = make(map[string]bool)
+	var addrs []string
+	for _, addr := range o.slots {
+		if len(addr) > 0 && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (o *RCluster) setSlot(slot int, addr string) {
+	o.mutex.Lock()
+	o.slots[slot] = addr
+	o.mutex.Unlock()
+}
+
+func (o *RCluster) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var err error
+	for addr, p := range o.pools {
+		if perr := p.Close(); perr != nil {
+			err = perr
+		}
+		delete(o.pools, addr)
+	}
+	return err
+}
+
+// Conn returns a connection that routes each command to the node owning its key.
+// prefix is prepended to every key, standing in for SELECT which cluster does not support
+func (o *RCluster) Conn(prefix string) redis.Conn {
+	return &rclusterConn{cluster: o, prefix: prefix}
+}
+
+type rclusterCmd struct {
+	cmd  string
+	args []interface{}
+}
+
+type rclusterReply struct {
+	reply interface{}
+	err   error
+}
+
+type rclusterConn struct {
+	cluster *RCluster
+	prefix  string
+	pending []rclusterCmd
+	replies []rclusterReply
+	// read timeout of the node commands, set by DoWithTimeout / ReceiveWithTimeout
+	timeout time.Duration
+	// context of the node commands, set by DoContext / ReceiveContext
+	ctx context.Context
+}
+
+// rkeyIndexes returns the positions of the keys in args, nil for keyless commands
+func rkeyIndexes(cmd string, args []interface{}) []int {
+	switch cmd {
+	case "PING", "SELECT", "DBSIZE", "INFO", "SCAN", "KEYS", "FLUSHDB", "FLUSHALL", "SCRIPT", "ROLE", "TIME", "CLUSTER", "ECHO":
+		return nil
+	case "OBJECT", "MEMORY":
+		if len(args) > 1 {
+			return []int{1}
+		}
+		return nil
+	case "DEL", "EXISTS", "UNLINK", "TOUCH", "MGET":
+		var indexes = make([]int, len(args))
+		for i := range args {
+			indexes[i] = i
+		}
+		return indexes
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			return nil
+		}
+		var numkeys, _ = strconv.Atoi(fmt.Sprint(args[1]))
+		var indexes []int
+		for i := 0; i < numkeys && i+2 < len(args); i++ {
+			indexes = append(indexes, i+2)
+		}
+		return indexes
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return []int{0}
+}
+
+func rkeyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(key)
+}
+
+func (c *rclusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if len(c.pending) > 0 {
+		c.Flush()
+	}
+	if len(cmd) == 0 {
+		var last rclusterReply
+		for _, r := range c.replies {
+			if r.err != nil && last.err == nil {
+				last.err = r.err
+			}
+			last.reply = r.reply
+		}
+		c.replies = nil
+		return last.reply, last.err
+	}
+	c.replies = nil
+	return c.exec(cmd, args)
+}
+
+func (c *rclusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	c.timeout = timeout
+	defer func() {
+		c.timeout = 0
+	}()
+	return c.Do(cmd, args...)
+}
+
+func (c *rclusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	c.timeout = timeout
+	defer func() {
+		c.timeout = 0
+	}()
+	return c.Receive()
+}
+
+func (c *rclusterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	c.ctx = ctx
+	defer func() {
+		c.ctx = nil
+	}()
+	return c.Do(cmd, args...)
+}
+
+func (c *rclusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	c.ctx = ctx
+	defer func() {
+		c.ctx = nil
+	}()
+	return c.Receive()
+}
+
+// do runs a command on a node connection
+func (c *rclusterConn) do(conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if c.ctx != nil {
+		return redis.DoContext(conn, c.ctx, cmd, args...)
+	}
+	if c.timeout > 0 {
+		return redis.DoWithTimeout(conn, c.timeout, cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+func (c *rclusterConn) receive(conn redis.Conn) (interface{}, error) {
+	if c.ctx != nil {
+		return redis.ReceiveContext(conn, c.ctx)
+	}
+	if c.timeout > 0 {
+		return redis.ReceiveWithTimeout(conn, c.timeout)
+	}
+	return conn.Receive()
+}
+
+func (c *rclusterConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, rclusterCmd{cmd: cmd, args: args})
+	return nil
+}
+
+// Flush sends the pending commands, one pipeline per node
+func (c *rclusterConn) Flush() error {
+	var pending = c.pending
+	c.pending = nil
+	var replies = make([]rclusterReply, len(pending))
+	var bynode = make(map[string][]int)
+	for i, one := range pending {
+		var ucmd = strings.ToUpper(one.cmd)
+		var indexes = rkeyIndexes(ucmd, one.args)
+		if len(indexes) != 1 || ucmd == "SELECT" {
+			// keyless and multi key commands are executed on their own
+			var reply, err = c.exec(one.cmd, one.args)
+			replies[i] = rclusterReply{reply, err}
+			continue
+		}
+		var args = c.prefixed(indexes, one.args)
+		pending[i].args = args
+		var addr, err = c.cluster.addr(RSlot(rkeyString(args[indexes[0]])))
+		if err != nil {
+			replies[i] = rclusterReply{nil, err}
+			continue
+		}
+		bynode[addr] = append(bynode[addr], i)
+	}
+
+	var wg sync.WaitGroup
+	for addr, indexes := range bynode {
+		wg.Add(1)
+		go func(addr string, indexes []int) {
+			defer wg.Done()
+			var conn = c.cluster.pool(addr).Get()
+			defer conn.Close()
+			for _, i := range indexes {
+				conn.Send(pending[i].cmd, pending[i].args...)
+			}
+			if err := conn.Flush(); err != nil {
+				for _, i := range indexes {
+					replies[i] = rclusterReply{nil, err}
+				}
+				return
+			}
+			for _, i := range indexes {
+				var reply, err = c.receive(conn)
+				replies[i] = rclusterReply{reply, err}
+			}
+		}(addr, indexes)
+	}
+	wg.Wait()
+
+	// redirected commands are replayed one by one
+	for i, r := range replies {
+		if _, _, redirect := rredirect(r.err); redirect {
+			var reply, err = c.execKeyed(pending[i].cmd, pending[i].args, rkeyIndexes(strings.ToUpper(pending[i].cmd), pending[i].args)[0])
+			replies[i] = rclusterReply{reply, err}
+		}
+	}
+	c.replies = append(c.replies, replies...)
+	return nil
+}
+
+func (c *rclusterConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 && len(c.pending) > 0 {
+		c.Flush()
+	}
+	if len(c.replies) == 0 {
+		return nil, errors.New("no pending reply to receive")
+	}
+	var r = c.replies[0]
+	c.replies = c.replies[1:]
+	return r.reply, r.err
+}
+
+func (c *rclusterConn) Close() error {
+	c.pending = nil
+	c.replies = nil
+	return nil
+}
+
+func (c *rclusterConn) Err() error {
+	return nil
+}
+
+func (c *rclusterConn) prefixed(indexes []int, args []interface{}) []interface{} {
+	if len(c.prefix) == 0 || len(indexes) == 0 {
+		return args
+	}
+	var copied = append([]interface{}(nil), args...)
+	for _, i := range indexes {
+		copied[i] = c.prefix + rkeyString(args[i])
+	}
+	return copied
+}
+
+func (c *rclusterConn) exec(cmd string, args []interface{}) (interface{}, error) {
+	var ucmd = strings.ToUpper(cmd)
+	if ucmd == "SELECT" {
+		return "OK", nil
+	}
+	var indexes = rkeyIndexes(ucmd, args)
+	args = c.prefixed(indexes, args)
+
+	if len(indexes) == 0 {
+		switch ucmd {
+		case "KEYS", "SCAN", "DBSIZE":
+			return c.fanout(ucmd, args)
+		}
+		var addr, err = c.cluster.anyAddr()
+		if err != nil {
+			return nil, err
+		}
+		return c.node(addr, cmd, args...)
+	}
+
+	if len(indexes) > 1 && ucmd != "EVAL" && ucmd != "EVALSHA" && ucmd != "MGET" {
+		// keys may live on different slots, split and sum the counts
+		var total int64
+		for _, i := range indexes {
+			var n, err = redis.Int64(c.execKeyed(cmd, []interface{}{args[i]}, 0))
+			if err != nil {
+				return nil, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+	if ucmd == "MGET" && len(indexes) > 1 {
+		var values = make([]interface{}, len(args))
+		for i := range args {
+			var vals, err = redis.Values(c.execKeyed(cmd, []interface{}{args[i]}, 0))
+			if err != nil {
+				return nil, err
+			}
+			if len(vals) > 0 {
+				values[i] = vals[0]
+			}
+		}
+		return values, nil
+	}
+	return c.execKeyed(cmd, args, indexes[0])
+}
+
+// node runs a command on the node at addr
+func (c *rclusterConn) node(addr string, cmd string, args ...interface{}) (interface{}, error) {
+	var conn = c.cluster.pool(addr).Get()
+	defer conn.Close()
+	return c.do(conn, cmd, args...)
+}
+
+// unprefixed takes the prefix off the keys of a reply
+func (c *rclusterConn) unprefixed(keys []interface{}) []interface{} {
+	var ret = make([]interface{}, len(keys))
+	for i, key := range keys {
+		ret[i] = []byte(strings.TrimPrefix(rkeyString(key), c.prefix))
+	}
+	return ret
+}
+
+// fanout runs the keyless reads KEYS, SCAN and DBSIZE on every master. patterns are put under the prefix
+// and the prefix is taken off the keys returned, so that they can be passed back as they are
+func (c *rclusterConn) fanout(ucmd string, args []interface{}) (interface{}, error) {
+	addrs, err := c.cluster.masters()
+	if err != nil {
+		return nil, err
+	}
+	switch ucmd {
+	case "KEYS":
+		var pattern = "*"
+		if len(args) > 0 {
+			pattern = rkeyString(args[0])
+		}
+		var keys = []interface{}{}
+		for _, addr := range addrs {
+			vals, err := redis.Values(c.node(addr, "KEYS", c.prefix+pattern))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, c.unprefixed(vals)...)
+		}
+		return keys, nil
+	case "DBSIZE":
+		var total int64
+		for _, addr := range addrs {
+			var n int64
+			if len(c.prefix) == 0 {
+				n, err = redis.Int64(c.node(addr, "DBSIZE"))
+			} else {
+				n, err = c.count(addr)
+			}
+			if err != nil {
+				return nil, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+	return c.scan(addrs, args)
+}
+
+// count counts the keys under the prefix on a node, DBSIZE knows nothing of prefixes
+func (c *rclusterConn) count(addr string) (int64, error) {
+	var total int64
+	var cursor = "0"
+	for {
+		vals, err := redis.Values(c.node(addr, "SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", 1000))
+		if err != nil {
+			return 0, err
+		}
+		if len(vals) < 2 {
+			return 0, errors.New("unexpected SCAN reply")
+		}
+		keys, err := redis.Values(vals[1], nil)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(len(keys))
+		if cursor, err = redis.String(vals[0], nil); err != nil || cursor == "0" {
+			return total, err
+		}
+	}
+}
+
+// scan walks the masters one after another. the cursor handed out is node cursor * len(masters) + node index,
+// it stays valid as long as the set of masters does not change
+func (c *rclusterConn) scan(addrs []string, args []interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("SCAN without cursor")
+	}
+	var n = uint64(len(addrs))
+	cursor, err := strconv.ParseUint(rkeyString(args[0]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %v", args[0])
+	}
+	var index, ncursor = cursor % n, cursor / n
+
+	var opts = []interface{}{ncursor}
+	var matched = false
+	for i := 1; i < len(args); i++ {
+		opts = append(opts, args[i])
+		if strings.ToUpper(rkeyString(args[i])) == "MATCH" && i+1 < len(args) {
+			opts = append(opts, c.prefix+rkeyString(args[i+1]))
+			matched = true
+			i++
+		}
+	}
+	if !matched && len(c.prefix) > 0 {
+		opts = append(opts, "MATCH", c.prefix+"*")
+	}
+
+	vals, err := redis.Values(c.node(addrs[index], "SCAN", opts...))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) < 2 {
+		return nil, errors.New("unexpected SCAN reply")
+	}
+	next, err := redis.Uint64(vals[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := redis.Values(vals[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	if next != 0 {
+		next = next*n + index
+	} else if index+1 < n {
+		next = index + 1
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), c.unprefixed(keys)}, nil
+}
+
+// rredirect parses MOVED / ASK errors
+func rredirect(err error) (addr string, ask bool, redirect bool) {
+	var rerr, ok = err.(redis.Error)
+	if !ok {
+		return "", false, false
+	}
+	var parts = strings.Fields(string(rerr))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return "", false, false
+	}
+	return parts[2], parts[0] == "ASK", true
+}
+
+// execKeyed runs a command on the node owning args[keyindex], following redirects
+func (c *rclusterConn) execKeyed(cmd string, args []interface{}, keyindex int) (interface{}, error) {
+	var slot = RSlot(rkeyString(args[keyindex]))
+	addr, err := c.cluster.addr(slot)
+	if err != nil {
+		return nil, err
+	}
+	var ask = false
+	for i := 0; ; i++ {
+		var reply interface{}
+		var conn = c.cluster.pool(addr).Get()
+		if ask {
+			conn.Send("ASKING")
+			conn.Send(cmd, args...)
+			conn.Flush()
+			c.receive(conn)
+			reply, err = c.receive(conn)
+		} else {
+			reply, err = c.do(conn, cmd, args...)
+		}
+		conn.Close()
+
+		if i >= RCLUSTER_REDIRECTS {
+			return reply, err
+		}
+		var raddr, rask, redirect = rredirect(err)
+		if redirect {
+			addr, ask = raddr, rask
+			if !rask {
+				c.cluster.setSlot(slot, raddr)
+				go c.cluster.Refresh()
+			}
+			continue
+		}
+		if rerr, ok := err.(redis.Error); ok {
+			var msg = string(rerr)
+			if strings.HasPrefix(msg, "TRYAGAIN") || strings.HasPrefix(msg, "CLUSTERDOWN") {
+				time.Sleep(time.Duration(i+1) * 50 * time.Millisecond)
+				ask = false
+				continue
+			}
+		}
+		return reply, err
+	}
+}
@@ -0,0 +1,327 @@
+package qredis
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRSlot(t *testing.T) {
+	var expects = map[string]int{
+		"123456789": 12739,
+		"foo":       12182,
+		"bar":       5061,
+		"{foo}.bar": 12182,
+		"a{bar}":    5061,
+	}
+	for key, slot := range expects {
+		if got := RSlot(key); got != slot {
+			t.Errorf("slot of %s = %d, expect %d", key, got, slot)
+		}
+	}
+	// an empty tag hashes the whole key
+	if RSlot("{}bar") == RSlot("") {
+		t.Error("empty hash tag must be ignored")
+	}
+}
+
+// rtestNode is a cluster node stand-in serving the slots in [from, to] out of an in-memory keyspace.
+// moved / asks redirect single keys elsewhere, importing keys are served only after ASKING
+type rtestNode struct {
+	*standin
+	from      int
+	to        int
+	mutex     sync.Mutex
+	kv        map[string]string
+	moved     map[string]string
+	asks      map[string]string
+	extra     map[string]bool
+	importing map[string]bool
+	slots     func() string
+}
+
+func newRTestNode(t *testing.T, from int, to int) *rtestNode {
+	var n = &rtestNode{
+		from:      from,
+		to:        to,
+		kv:        map[string]string{},
+		moved:     map[string]string{},
+		asks:      map[string]string{},
+		extra:     map[string]bool{},
+		importing: map[string]bool{},
+	}
+	n.standin = newTCPStandin(t, n.handle)
+	return n
+}
+
+func rtestBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func rtestArray(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+func (n *rtestNode) handle(args []string, asking bool) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "CLUSTER":
+		return n.slots()
+	case "DBSIZE":
+		return fmt.Sprintf(":%d\r\n", len(n.kv))
+	case "KEYS":
+		var keys []string
+		for _, key := range n.match(args[1]) {
+			keys = append(keys, rtestBulk(key))
+		}
+		return rtestArray(keys...)
+	case "SCAN":
+		var cursor, _ = strconv.Atoi(args[1])
+		var pattern, count = "*", 10
+		for i := 2; i+1 < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "MATCH":
+				pattern = args[i+1]
+			case "COUNT":
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		var all = n.match(pattern)
+		var end = cursor + count
+		if end >= len(all) {
+			end = len(all)
+		}
+		var keys []string
+		for _, key := range all[cursor:end] {
+			keys = append(keys, rtestBulk(key))
+		}
+		var next = end
+		if end == len(all) {
+			next = 0
+		}
+		return rtestArray(rtestBulk(strconv.Itoa(next)), rtestArray(keys...))
+	case "GET", "SET":
+		var key = args[1]
+		if addr, ok := n.moved[key]; ok {
+			return fmt.Sprintf("-MOVED %d %s\r\n", RSlot(key), addr)
+		}
+		if addr, ok := n.asks[key]; ok {
+			return fmt.Sprintf("-ASK %d %s\r\n", RSlot(key), addr)
+		}
+		var slot = RSlot(key)
+		if (slot < n.from || slot > n.to) && !n.extra[key] && !(asking && n.importing[key]) {
+			return fmt.Sprintf("-ERR slot %d not served here\r\n", slot)
+		}
+		if strings.ToUpper(args[0]) == "SET" {
+			n.kv[key] = args[2]
+			return "+OK\r\n"
+		}
+		if val, ok := n.kv[key]; ok {
+			return rtestBulk(val)
+		}
+		return "$-1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (n *rtestNode) match(pattern string) []string {
+	var keys []string
+	for key := range n.kv {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setup changes the node state while it serves
+func (n *rtestNode) setup(change func()) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	change()
+}
+
+func (n *rtestNode) get(key string) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.kv[key]
+}
+
+func (n *rtestNode) keys() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.match("*")
+}
+
+// newRTestCluster splits the slots between two nodes
+func newRTestCluster(t *testing.T) (*RCluster, *rtestNode, *rtestNode) {
+	var a = newRTestNode(t, 0, RCLUSTER_SLOTS/2-1)
+	var b = newRTestNode(t, RCLUSTER_SLOTS/2, RCLUSTER_SLOTS-1)
+	var slots = func() string {
+		var ranges []string
+		for _, n := range []*rtestNode{a, b} {
+			var host, port, _ = net.SplitHostPort(n.addr())
+			ranges = append(ranges, rtestArray(
+				fmt.Sprintf(":%d\r\n", n.from), fmt.Sprintf(":%d\r\n", n.to),
+				rtestArray(rtestBulk(host), ":"+port+"\r\n")))
+		}
+		return rtestArray(ranges...)
+	}
+	a.slots, b.slots = slots, slots
+	var cluster = NewRCluster([]string{a.addr()}, func(addr string) *redis.Pool {
+		return &redis.Pool{Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		}}
+	})
+	return cluster, a, b
+}
+
+func TestRClusterRouting(t *testing.T) {
+	var cluster, a, b = newRTestCluster(t)
+	defer a.listener.Close()
+	defer b.listener.Close()
+	defer cluster.Close()
+
+	// a key of another db must stay out of sight
+	b.setup(func() {
+		b.kv["2:other"] = "x"
+	})
+
+	var conn = cluster.Conn("1:")
+	defer conn.Close()
+	var ids []string
+	for i := 0; i < 20; i++ {
+		var id = fmt.Sprintf("key%d", i)
+		ids = append(ids, id)
+		conn.Send("SET", id, "v"+id)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for range ids {
+		if reply, err := redis.String(conn.Receive()); err != nil || reply != "OK" {
+			t.Fatalf("SET %v %v", reply, err)
+		}
+	}
+	for _, n := range []*rtestNode{a, b} {
+		for _, key := range n.keys() {
+			if slot := RSlot(key); key != "2:other" && (!strings.HasPrefix(key, "1:") || slot < n.from || slot > n.to) {
+				t.Fatalf("%s landed on the node of slots %d-%d", key, n.from, n.to)
+			}
+		}
+	}
+	// b holds 2:other besides
+	if len(a.keys()) == 0 || len(b.keys()) <= 1 {
+		t.Fatal("keys are expected on both nodes")
+	}
+
+	// the replies of a pipeline come back in the order sent
+	for _, id := range ids {
+		conn.Send("GET", id)
+	}
+	conn.Flush()
+	for _, id := range ids {
+		if val, err := redis.String(conn.Receive()); err != nil || val != "v"+id {
+			t.Fatalf("GET %s = %v %v", id, val, err)
+		}
+	}
+
+	keys, err := redis.Strings(conn.Do("KEYS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	var expects = append([]string(nil), ids...)
+	sort.Strings(expects)
+	if fmt.Sprint(keys) != fmt.Sprint(expects) {
+		t.Fatalf("KEYS %v", keys)
+	}
+
+	size, err := redis.Int(conn.Do("DBSIZE"))
+	if err != nil || size != len(ids) {
+		t.Fatalf("DBSIZE %d %v", size, err)
+	}
+
+	// the scan goes through both nodes, and the keys it returns can be passed back
+	var scanned []string
+	var cursor = 0
+	for {
+		vals, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "key*", "COUNT", 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor, _ = redis.Int(vals[0], nil)
+		var page, _ = redis.Strings(vals[1], nil)
+		for _, key := range page {
+			if val, err := redis.String(conn.Do("GET", key)); err != nil || val != "v"+key {
+				t.Fatalf("GET %s = %v %v", key, val, err)
+			}
+		}
+		scanned = append(scanned, page...)
+		if cursor == 0 {
+			break
+		}
+	}
+	sort.Strings(scanned)
+	if fmt.Sprint(scanned) != fmt.Sprint(expects) {
+		t.Fatalf("SCAN %v", scanned)
+	}
+}
+
+func TestRClusterRedirect(t *testing.T) {
+	var cluster, a, b = newRTestCluster(t)
+	defer a.listener.Close()
+	defer b.listener.Close()
+	defer cluster.Close()
+	var conn = cluster.Conn("")
+	defer conn.Close()
+
+	// foo belongs to b by the slot map but has moved to a
+	b.setup(func() {
+		b.moved["foo"] = a.addr()
+	})
+	a.setup(func() {
+		a.extra["foo"] = true
+	})
+	if _, err := conn.Do("SET", "foo", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if a.get("foo") != "1" {
+		t.Fatal("MOVED not followed")
+	}
+
+	// bar belongs to a and is being migrated to b
+	a.setup(func() {
+		a.asks["bar"] = b.addr()
+	})
+	b.setup(func() {
+		b.importing["bar"] = true
+	})
+	if _, err := conn.Do("SET", "bar", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if b.get("bar") != "2" {
+		t.Fatal("ASK not followed")
+	}
+	if addr, _ := cluster.addr(RSlot("bar")); addr != a.addr() {
+		t.Fatal("ASK must not change the slot map")
+	}
+
+	// redirects inside a pipeline are replayed
+	conn.Send("GET", "foo")
+	conn.Send("GET", "bar")
+	conn.Flush()
+	for _, expect := range []string{"1", "2"} {
+		if val, err := redis.String(conn.Receive()); err != nil || val != expect {
+			t.Fatalf("GET = %v %v, expect %s", val, err, expect)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package qredis
+
+import (
+	"context"
+	"fmt"
+	"github.com/camsiabor/qcom/qlog"
+	"github.com/camsiabor/qcom/util"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+/* ============================ log ========================== */
+
+const RLOG_ARG_MAX = 64
+
+type RLogger interface {
+	Printf(format string, v ...interface{})
+}
+
+// RLogConn logs the commands going through conn: all of them with Commands, failed ones with Errors,
+// and those taking longer than Slow when Slow > 0. pipelined commands are logged as their replies
+// are received, timed from Send
+type RLogConn struct {
+	redis.Conn
+	Logger   RLogger
+	Commands bool
+	Errors   bool
+	Slow     time.Duration
+
+	// commands sent and not received yet
+	sent []rlogSent
+}
+
+type rlogSent struct {
+	cmd   string
+	args  []interface{}
+	start time.Time
+}
+
+// logConn wraps conn by option "log_commands", "log_errors" and "slow_log" (ms), as is when none is set
+func (o *DaoRedis) logConn(conn redis.Conn, err error) (redis.Conn, error) {
+	if err != nil {
+		return conn, err
+	}
+	var c = &RLogConn{
+		Conn:     conn,
+		Logger:   qlog.GetLogManager().GetDef(),
+		Commands: util.GetBool(o.Options, false, "log_commands"),
+		Errors:   util.GetBool(o.Options, false, "log_errors"),
+		Slow:     time.Duration(util.GetInt(o.Options, 0, "slow_log")) * time.Millisecond,
+	}
+	if !c.Commands && !c.Errors && c.Slow <= 0 {
+		return conn, nil
+	}
+	return c, nil
+}
+
+func (c *RLogConn) log(cmd string, args []interface{}, took time.Duration, err error) {
+	if len(cmd) == 0 {
+		return
+	}
+	if err != nil && c.Errors {
+		c.Logger.Printf("redis %s failed after %v : %v", RLogArgs(cmd, args), took, err)
+	} else if c.Slow > 0 && took > c.Slow {
+		c.Logger.Printf("redis slow %s took %v", RLogArgs(cmd, args), took)
+	} else if c.Commands {
+		c.Logger.Printf("redis %s took %v", RLogArgs(cmd, args), took)
+	}
+}
+
+// received logs the reply of the oldest command sent
+func (c *RLogConn) received(err error) {
+	if len(c.sent) == 0 {
+		return
+	}
+	var sent = c.sent[0]
+	c.sent = c.sent[1:]
+	c.log(sent.cmd, sent.args, time.Since(sent.start), err)
+}
+
+// done logs a Do, which receives every pending reply before its own. the error it returns
+// may come from a pending command, it is logged with the Do
+func (c *RLogConn) done(cmd string, args []interface{}, start time.Time, err error) {
+	for len(c.sent) > 0 {
+		c.received(nil)
+	}
+	c.log(cmd, args, time.Since(start), err)
+}
+
+func (c *RLogConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	var start = time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	c.done(cmd, args, start, err)
+	return reply, err
+}
+
+func (c *RLogConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	var start = time.Now()
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	c.done(cmd, args, start, err)
+	return reply, err
+}
+
+func (c *RLogConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	var start = time.Now()
+	reply, err := redis.DoContext(c.Conn, ctx, cmd, args...)
+	c.done(cmd, args, start, err)
+	return reply, err
+}
+
+func (c *RLogConn) Send(cmd string, args ...interface{}) error {
+	var err = c.Conn.Send(cmd, args...)
+	if err != nil {
+		c.log(cmd, args, 0, err)
+		return err
+	}
+	c.sent = append(c.sent, rlogSent{cmd: cmd, args: args, start: time.Now()})
+	return nil
+}
+
+func (c *RLogConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.received(err)
+	return reply, err
+}
+
+func (c *RLogConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	c.received(err)
+	return reply, err
+}
+
+func (c *RLogConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	reply, err := redis.ReceiveContext(c.Conn, ctx)
+	c.received(err)
+	return reply, err
+}
+
+func (c *RLogConn) Close() error {
+	c.sent = nil
+	return c.Conn.Close()
+}
+
+// RLogArgs formats a command for logs, credentials of AUTH / HELLO masked and long args cut
+func RLogArgs(cmd string, args []interface{}) string {
+	var parts = make([]string, 0, len(args)+1)
+	parts = append(parts, cmd)
+	switch strings.ToUpper(cmd) {
+	case "AUTH", "HELLO":
+		if len(args) > 0 {
+			parts = append(parts, "[REDACTED]")
+		}
+		return strings.Join(parts, " ")
+	}
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case []byte:
+			s = string(v)
+		default:
+			s = fmt.Sprint(v)
+		}
+		if len(s) > RLOG_ARG_MAX {
+			s = s[:RLOG_ARG_MAX] + fmt.Sprintf("...(%d)", len(s))
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,385 @@
+package qredis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/* ============================ query ========================== */
+
+// query language accepted by DaoRedis.Query
+//
+//	HGETALL <group> [WHERE <field> <op> <value> [AND ...]] [ORDER BY <field> [ASC|DESC]] [LIMIT <n> [OFFSET <m>]]
+//
+// op is one of = != <> > >= < <=, value is a number, a quoted string, true, false, null or ?,
+// each ? is bound to the next element of args. fields may be dotted paths into nested objects.
+
+type RQuery struct {
+	Cmd    string   `json:"-"`
+	Group  string   `json:"-"`
+	Where  []RQCond `json:"where"`
+	Order  string   `json:"order"`
+	Desc   bool     `json:"desc"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+}
+
+type RQCond struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+const (
+	rqWord = iota
+	rqString
+	rqOp
+	rqParam
+)
+
+type rqToken struct {
+	kind int
+	text string
+}
+
+func rqTokenize(query string) ([]rqToken, error) {
+	var tokens []rqToken
+	var runes = []rune(query)
+	var n = len(runes)
+	for i := 0; i < n; {
+		var c = runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			var closed = false
+			for i++; i < n; i++ {
+				if runes[i] == '\\' && i+1 < n {
+					i++
+					sb.WriteRune(runes[i])
+					continue
+				}
+				if runes[i] == c {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated string in query %s", query)
+			}
+			tokens = append(tokens, rqToken{rqString, sb.String()})
+		case strings.ContainsRune("=!<>", c):
+			var op = string(c)
+			if i+1 < n && strings.ContainsRune("=>", runes[i+1]) {
+				op = op + string(runes[i+1])
+			}
+			i += len(op)
+			tokens = append(tokens, rqToken{rqOp, op})
+		case c == '?':
+			i++
+			tokens = append(tokens, rqToken{rqParam, "?"})
+		default:
+			var start = i
+			for i < n && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("=!<>?'\"", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, rqToken{rqWord, string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
+
+// RParseQuery parses a query statement and binds its ? placeholders to args
+func RParseQuery(query string, args []interface{}) (*RQuery, error) {
+	tokens, err := rqTokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	var pos = 0
+	var argpos = 0
+	var next = func() (rqToken, bool) {
+		if pos >= len(tokens) {
+			return rqToken{}, false
+		}
+		pos++
+		return tokens[pos-1], true
+	}
+	var keyword = func(expect string) bool {
+		if pos < len(tokens) && tokens[pos].kind == rqWord && strings.EqualFold(tokens[pos].text, expect) {
+			pos++
+			return true
+		}
+		return false
+	}
+	var name = func(what string) (string, error) {
+		var tok, ok = next()
+		if !ok || (tok.kind != rqWord && tok.kind != rqString) {
+			return "", fmt.Errorf("%s expected in query %s", what, query)
+		}
+		return tok.text, nil
+	}
+	var integer = func(what string) (int, error) {
+		var tok, ok = next()
+		if ok && tok.kind == rqParam {
+			if argpos >= len(args) {
+				return 0, fmt.Errorf("not enough args for query %s", query)
+			}
+			argpos++
+			return strconv.Atoi(fmt.Sprint(args[argpos-1]))
+		}
+		if !ok || tok.kind != rqWord {
+			return 0, fmt.Errorf("%s expected in query %s", what, query)
+		}
+		return strconv.Atoi(tok.text)
+	}
+
+	var q = &RQuery{Where: []RQCond{}}
+	if !keyword("HGETALL") {
+		return nil, fmt.Errorf("query must start with HGETALL: %s", query)
+	}
+	q.Cmd = "HGETALL"
+	if q.Group, err = name("group"); err != nil {
+		return nil, err
+	}
+
+	if keyword("WHERE") {
+		for {
+			var cond RQCond
+			if cond.Field, err = name("field"); err != nil {
+				return nil, err
+			}
+			var tok, ok = next()
+			if !ok || tok.kind != rqOp {
+				return nil, fmt.Errorf("operator expected after %s in query %s", cond.Field, query)
+			}
+			switch tok.text {
+			case "=", "==":
+				cond.Op = "="
+			case "!=", "<>":
+				cond.Op = "!="
+			case ">", ">=", "<", "<=":
+				cond.Op = tok.text
+			default:
+				return nil, fmt.Errorf("unknown operator %s in query %s", tok.text, query)
+			}
+			if tok, ok = next(); !ok {
+				return nil, fmt.Errorf("value expected after %s %s in query %s", cond.Field, cond.Op, query)
+			}
+			switch tok.kind {
+			case rqString:
+				cond.Value = tok.text
+			case rqParam:
+				if argpos >= len(args) {
+					return nil, fmt.Errorf("not enough args for query %s", query)
+				}
+				cond.Value = args[argpos]
+				argpos++
+			case rqWord:
+				switch strings.ToLower(tok.text) {
+				case "true":
+					cond.Value = true
+				case "false":
+					cond.Value = false
+				case "null":
+					cond.Value = nil
+				default:
+					var f, perr = strconv.ParseFloat(tok.text, 64)
+					if perr != nil {
+						return nil, fmt.Errorf("invalid value %s in query %s", tok.text, query)
+					}
+					cond.Value = f
+				}
+			default:
+				return nil, fmt.Errorf("value expected after %s %s in query %s", cond.Field, cond.Op, query)
+			}
+			q.Where = append(q.Where, cond)
+			if !keyword("AND") {
+				break
+			}
+		}
+	}
+
+	if keyword("ORDER") {
+		if !keyword("BY") {
+			return nil, fmt.Errorf("BY expected after ORDER in query %s", query)
+		}
+		if q.Order, err = name("order field"); err != nil {
+			return nil, err
+		}
+		if keyword("DESC") {
+			q.Desc = true
+		} else {
+			keyword("ASC")
+		}
+	}
+
+	if keyword("LIMIT") {
+		if q.Limit, err = integer("limit"); err != nil {
+			return nil, err
+		}
+		if keyword("OFFSET") {
+			if q.Offset, err = integer("offset"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s in query %s", tokens[pos].text, query)
+	}
+	if argpos != len(args) {
+		return nil, fmt.Errorf("query %s takes %d args, %d given", query, argpos, len(args))
+	}
+	if q.Limit < 0 || q.Offset < 0 {
+		return nil, fmt.Errorf("negative limit or offset in query %s", query)
+	}
+	return q, nil
+}
+
+// KEYS[1] = group, ARGV[1] = json encoded RQuery
+// returns the matching field / raw value pairs
+var _rquery = redis.NewScript(1, `
+local plan = cjson.decode(ARGV[1])
+
+local function get(doc, path)
+	local v = doc
+	for part in string.gmatch(path, '[^%.]+') do
+		if type(v) ~= 'table' then
+			return nil
+		end
+		v = v[part]
+	end
+	if v == cjson.null then
+		return nil
+	end
+	return v
+end
+
+local function match(a, op, b)
+	if b == cjson.null then
+		b = nil
+	end
+	if op == '=' then
+		return a == b
+	end
+	if op == '!=' then
+		return a ~= b
+	end
+	if a == nil or b == nil or type(a) ~= type(b) or (type(a) ~= 'number' and type(a) ~= 'string') then
+		return false
+	end
+	if op == '>' then
+		return a > b
+	elseif op == '>=' then
+		return a >= b
+	elseif op == '<' then
+		return a < b
+	elseif op == '<=' then
+		return a <= b
+	end
+	return false
+end
+
+local function sortable(v)
+	if type(v) == 'boolean' then
+		if v then
+			return 1
+		end
+		return 0
+	end
+	if type(v) ~= 'number' and type(v) ~= 'string' then
+		return nil
+	end
+	return v
+end
+
+local rows = {}
+local want = plan.offset + plan.limit
+local cursor = '0'
+repeat
+	local reply = redis.call('HSCAN', KEYS[1], cursor, 'COUNT', 1000)
+	cursor = reply[1]
+	local kvs = reply[2]
+	for i = 1, #kvs, 2 do
+		local ok, doc = pcall(cjson.decode, kvs[i + 1])
+		if ok and type(doc) == 'table' then
+			local pass = true
+			for _, c in ipairs(plan.where) do
+				if not match(get(doc, c.field), c.op, c.value) then
+					pass = false
+					break
+				end
+			end
+			if pass then
+				rows[#rows + 1] = { kvs[i], kvs[i + 1], doc }
+			end
+		end
+	end
+	if plan.order == '' and plan.limit > 0 and #rows >= want then
+		break
+	end
+until cursor == '0'
+
+if plan.order ~= '' then
+	table.sort(rows, function(x, y)
+		local a = sortable(get(x[3], plan.order))
+		local b = sortable(get(y[3], plan.order))
+		if a == nil then
+			return false
+		end
+		if b == nil then
+			return true
+		end
+		if type(a) ~= type(b) then
+			return type(a) < type(b)
+		end
+		if plan.desc then
+			return a > b
+		end
+		return a < b
+	end)
+end
+
+local out = {}
+local last = #rows
+if plan.limit > 0 and want < last then
+	last = want
+end
+for i = plan.offset + 1, last do
+	out[#out + 1] = rows[i][1]
+	out[#out + 1] = rows[i][2]
+end
+return out
+`)
+
+func (q *RQuery) run(conn redis.Conn) ([]interface{}, error) {
+	plan, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	keyvals, err := redis.Strings(_rquery.Do(conn, q.Group, string(plan)))
+	if err != nil {
+		return nil, err
+	}
+	var keyvalslen = len(keyvals)
+	var rets = make([]interface{}, keyvalslen>>1)
+	for n, i := 0, 0; i < keyvalslen; n, i = n+1, i+2 {
+		var v interface{}
+		if err = json.Unmarshal([]byte(keyvals[i+1]), &v); err != nil {
+			return nil, err
+		}
+		// cjson decodes arrays to tables as well, they come back as they are, without id
+		if m, ok := v.(map[string]interface{}); ok {
+			m["id"] = keyvals[i]
+		}
+		rets[n] = v
+	}
+	return rets, nil
+}
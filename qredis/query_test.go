@@ -0,0 +1,113 @@
+package qredis
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRParseQuery(t *testing.T) {
+	q, err := RParseQuery(`hgetall stock:day WHERE price > 10 AND name != 'o\'neil' AND meta.ok = ? ORDER BY price DESC LIMIT 50 OFFSET ?`,
+		[]interface{}{true, 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect = &RQuery{
+		Cmd:   "HGETALL",
+		Group: "stock:day",
+		Where: []RQCond{
+			{Field: "price", Op: ">", Value: float64(10)},
+			{Field: "name", Op: "!=", Value: "o'neil"},
+			{Field: "meta.ok", Op: "=", Value: true},
+		},
+		Order:  "price",
+		Desc:   true,
+		Limit:  50,
+		Offset: 100,
+	}
+	if !reflect.DeepEqual(q, expect) {
+		t.Fatalf("parsed %+v, expect %+v", q, expect)
+	}
+
+	q, err = RParseQuery("HGETALL users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Group != "users" || len(q.Where) != 0 || q.Limit != 0 {
+		t.Fatalf("unexpected %+v", q)
+	}
+}
+
+func TestRParseQueryError(t *testing.T) {
+	var bad = []struct {
+		query string
+		args  []interface{}
+	}{
+		{"GET users", nil},
+		{"HGETALL", nil},
+		{"HGETALL users WHERE age", nil},
+		{"HGETALL users WHERE age ~ 1", nil},
+		{"HGETALL users WHERE age > abc", nil},
+		{"HGETALL users WHERE name = 'abc", nil},
+		{"HGETALL users WHERE age > ?", nil},
+		{"HGETALL users WHERE age > 1", []interface{}{1}},
+		{"HGETALL users ORDER age", nil},
+		{"HGETALL users LIMIT x", nil},
+		{"HGETALL users LIMIT 1 extra", nil},
+	}
+	for _, one := range bad {
+		if _, err := RParseQuery(one.query, one.args); err == nil {
+			t.Errorf("expect error for %s %v", one.query, one.args)
+		}
+	}
+}
+
+func TestRQuery(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+	server.data(func(store *rtestStore) {
+		var h = store.hash("stock")
+		h["s1"] = `{"price":5,"name":"x","meta":{"ok":true}}`
+		h["s2"] = `{"price":20,"name":"y","meta":{"ok":true}}`
+		h["s3"] = `{"price":15,"name":"z","meta":{"ok":false}}`
+		h["s4"] = `{"price":30,"meta":{"ok":true,"note":null}}`
+		h["s5"] = `not json`
+	})
+
+	rets, err := dao.Query("default", `HGETALL stock WHERE price > ? AND meta.ok = true ORDER BY price DESC`, []interface{}{10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []interface{}
+	for _, ret := range rets.([]interface{}) {
+		ids = append(ids, ret.(map[string]interface{})["id"])
+	}
+	if fmt.Sprint(ids) != "[s4 s2]" {
+		t.Fatalf("queried %v", ids)
+	}
+
+	// a missing field sorts last, limit and offset apply after the sort
+	if rets, err = dao.Query("default", `HGETALL stock ORDER BY name LIMIT 2 OFFSET 1`, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rets) != "[map[id:s2 meta:map[ok:true] name:y price:20] map[id:s3 meta:map[ok:false] name:z price:15]]" {
+		t.Fatalf("queried %v", rets)
+	}
+	if rets, err = dao.Query("default", `HGETALL stock WHERE meta.note = null AND price >= 30`, nil, nil); err != nil || len(rets.([]interface{})) != 1 {
+		t.Fatalf("null matched %v %v", rets, err)
+	}
+
+	// a value decoding to an array does not fail the query
+	server.data(func(store *rtestStore) { store.hash("stock")["s6"] = `[1,2]` })
+	if rets, err = dao.Query("default", `HGETALL stock WHERE price < 10`, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rets) != "[map[id:s1 meta:map[ok:true] name:x price:5]]" {
+		t.Fatalf("queried %v", rets)
+	}
+	if rets, err = dao.Query("default", `HGETALL stock`, nil, nil); err != nil || len(rets.([]interface{})) != 5 {
+		t.Fatalf("queried %v %v", rets, err)
+	}
+}
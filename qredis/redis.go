@@ -1,6 +1,7 @@
 package qredis
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/camsiabor/qcom/qdao"
@@ -9,14 +10,39 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // http://eastfisher.org/2018/03/18/redigo_study/
 
+// group settings (ttl, maxfields) are kept in a sibling hash
+const GROUP_META_PREFIX = "_qdao_group:"
+
+// seconds the group settings are cached for, other processes may change them with UpdateGroup
+const RGROUP_LIMITS_TTL = 10
+
 type DaoRedis struct {
 	qdao.Config
 	pool *redis.Pool
+
+	// replica pool, only with sentinel and read_replica
+	rpool    *redis.Pool
+	sentinel *RSentinel
+
+	// slot aware routing, only with cluster
+	cluster *RCluster
+
+	gmutex sync.RWMutex
+	limits map[string]rgroupLimits
+}
+
+// rgroupLimits are the group settings enforced on write, 0 means none
+type rgroupLimits struct {
+	maxfields int
+	ttl       int
+	expire    time.Time
 }
 
 func (o *DaoRedis) Configure(
@@ -34,30 +60,102 @@ func (o *DaoRedis) Conn() (interface{}, error) {
 	o.Lock()
 	defer o.UnLock()
 	if o.pool == nil {
-		o.pool = &redis.Pool{
-			MaxIdle:     o.MaxIdle,
-			IdleTimeout: time.Duration(o.IdleTimeout) * time.Second,
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", o.Host+":"+strconv.Itoa(o.Port),
-					redis.DialDatabase(redisdb),
-					redis.DialPassword(o.Pass),
-					redis.DialKeepAlive(time.Duration(o.KeepAlive)*time.Second),
-				)
-				if err != nil {
-					return nil, err
-				}
-				return c, err
-			},
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, err := c.Do("PING")
-				return err
-			},
+		tlsopts, err := o.tlsDialOptions()
+		if err != nil {
+			return nil, err
+		}
+		var dialopts = []redis.DialOption{
+			redis.DialPassword(o.Pass),
+			redis.DialKeepAlive(time.Duration(o.KeepAlive) * time.Second),
+		}
+		if len(o.User) > 0 {
+			// redis 6 ACL user, AUTH <user> <pass>
+			dialopts = append(dialopts, redis.DialUsername(o.User))
+		}
+		dialopts = append(dialopts, tlsopts...)
+		var dial = func(addr string) (redis.Conn, error) {
+			return o.logConn(redis.Dial("tcp", addr, append(dialopts, redis.DialDatabase(redisdb))...))
+		}
+
+		var sentinels = RStrings(o.Options["sentinels"])
+		if util.GetBool(o.Options, false, "cluster") {
+			// cluster has no logical database, see keyPrefix
+			var seeds = RStrings(o.Options["cluster_nodes"])
+			if len(seeds) == 0 {
+				seeds = []string{o.Host + ":" + strconv.Itoa(o.Port)}
+			}
+			o.cluster = NewRCluster(seeds, func(addr string) *redis.Pool {
+				return o.newPool(func() (redis.Conn, error) {
+					return o.logConn(redis.Dial("tcp", addr, dialopts...))
+				})
+			})
+			o.pool = o.newPool(func() (redis.Conn, error) {
+				return o.cluster.Conn(""), nil
+			})
+		} else if len(sentinels) > 0 {
+			var master = util.GetStr(o.Options, "mymaster", "master_name")
+			var spass = util.GetStr(o.Options, "", "sentinel_pass")
+			o.sentinel = NewRSentinel(sentinels, master, spass, tlsopts...)
+			o.pool = o.newPool(func() (redis.Conn, error) {
+				return o.sentinel.DialMaster(dial)
+			})
+			o.pool.TestOnBorrow = o.sentinel.TestMaster
+			if util.GetBool(o.Options, false, "read_replica") {
+				o.rpool = o.newPool(func() (redis.Conn, error) {
+					return o.sentinel.DialReplica(dial)
+				})
+			}
+		} else {
+			var addr = o.Host + ":" + strconv.Itoa(o.Port)
+			o.pool = o.newPool(func() (redis.Conn, error) {
+				return dial(addr)
+			})
 		}
 	}
 
+	// the pool is the agent, operations borrow from it and give back when done
 	var conn = o.pool.Get()
+	defer conn.Close()
 	var _, err = conn.Do("PING")
-	return conn, err
+	return o.pool, err
+}
+
+func (o *DaoRedis) tlsDialOptions() ([]redis.DialOption, error) {
+	if !util.GetBool(o.Options, false, "tls") {
+		return nil, nil
+	}
+	config, err := RTLSConfig(
+		util.GetStr(o.Options, "", "tls_ca"),
+		util.GetStr(o.Options, "", "tls_cert"),
+		util.GetStr(o.Options, "", "tls_key"),
+		util.GetStr(o.Options, o.Host, "tls_server_name"),
+		util.GetBool(o.Options, false, "tls_skip_verify"))
+	if err != nil {
+		return nil, err
+	}
+	return []redis.DialOption{
+		redis.DialUseTLS(true),
+		redis.DialTLSConfig(config),
+		redis.DialTLSSkipVerify(config.InsecureSkipVerify),
+	}, nil
+}
+
+func (o *DaoRedis) newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     o.MaxIdle,
+		MaxActive:   util.GetInt(o.Options, 0, "max_active"),
+		Wait:        util.GetBool(o.Options, false, "wait"),
+		IdleTimeout: time.Duration(o.IdleTimeout) * time.Second,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// the pool does not look at Err of idle connections, a sentinel failover shows there
+			if err := c.Err(); err != nil {
+				return err
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
 }
 
 func (o *DaoRedis) IsConnected() bool {
@@ -68,6 +166,7 @@ func (o *DaoRedis) IsConnected() bool {
 	if conn == nil {
 		return false
 	}
+	defer conn.Close()
 	var _, err = conn.Do("PING")
 	if err == nil {
 		return true
@@ -77,6 +176,12 @@ func (o *DaoRedis) IsConnected() bool {
 }
 
 func (o *DaoRedis) Close() error {
+	if o.rpool != nil {
+		o.rpool.Close()
+	}
+	if o.cluster != nil {
+		o.cluster.Close()
+	}
 	if o.pool != nil {
 		return o.pool.Close()
 	}
@@ -91,7 +196,11 @@ func (o *DaoRedis) Agent() (interface{}, error) {
 }
 
 func (o *DaoRedis) SelectDB(db string) error {
+	if o.cluster != nil {
+		return nil
+	}
 	var conn = o.pool.Get()
+	defer conn.Close()
 	var rdb = o.DBMapping[db]
 	if rdb == nil {
 		rdb = 0
@@ -142,33 +251,228 @@ func (o *DaoRedis) UpdateDB(db string, options interface{}, create bool, overrid
 }
 
 func (o *DaoRedis) UpdateGroup(db string, group string, options interface{}, create bool, override bool, opt qdao.UOpt) (interface{}, error) {
-	panic("implement")
+	if len(group) == 0 {
+		return false, errors.New("group name is empty")
+	}
+	exist, err := o.ExistGroup(db, group)
+	if err != nil {
+		return false, err
+	}
+	if !exist && !create {
+		return false, nil
+	}
+
 	var conn = o.GetConn(db)
-	var exist bool
-	if !create {
-		exist, err := o.ExistGroup(db, group)
-		if exist || err != nil {
-			return nil, err
+	defer conn.Close()
+	var meta = GROUP_META_PREFIX + group
+	if exist && override {
+		if _, err = conn.Do("DEL", group, meta); err != nil {
+			return false, err
 		}
+		exist = false
 	}
-	if !override && exist {
-		return nil, nil
+
+	var now = time.Now().Unix()
+	var ttl = util.GetInt(options, -1, "ttl")
+	var maxfields = util.GetInt(options, -1, "maxfields")
+	var args = redis.Args{}.Add(meta)
+	if !exist {
+		args = args.Add("created", now)
+	}
+	args = args.Add("updated", now)
+	if ttl >= 0 {
+		args = args.Add("ttl", ttl)
+	}
+	if maxfields >= 0 {
+		args = args.Add("maxfields", maxfields)
+	}
+	if _, err = conn.Do("HMSET", args...); err != nil {
+		return false, err
+	}
+
+	// the meta hash stays, the ttl is applied again whenever Update creates the group hash anew
+	if ttl > 0 {
+		_, err = conn.Do("EXPIRE", group, ttl)
+	} else if ttl == 0 {
+		_, err = conn.Do("PERSIST", group)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	o.gmutex.Lock()
+	delete(o.limits, db+"."+group)
+	o.gmutex.Unlock()
+	return true, nil
+}
+
+// groupLimits returns the settings of a group kept by UpdateGroup in its meta hash
+func (o *DaoRedis) groupLimits(conn redis.Conn, db string, group string) (rgroupLimits, error) {
+	var gkey = db + "." + group
+	o.gmutex.RLock()
+	var limits, ok = o.limits[gkey]
+	o.gmutex.RUnlock()
+	var now = time.Now()
+	if ok && now.Before(limits.expire) {
+		return limits, nil
+	}
+	vals, err := redis.Values(conn.Do("HMGET", GROUP_META_PREFIX+group, "maxfields", "ttl"))
+	if err != nil {
+		return rgroupLimits{}, err
+	}
+	limits.maxfields, _ = redis.Int(vals[0], nil)
+	limits.ttl, _ = redis.Int(vals[1], nil)
+	// no meta yet, the group may be declared any time
+	if vals[0] == nil && vals[1] == nil {
+		return limits, nil
 	}
-	conn.Do("HSET", group, "_", "{}")
-	conn.Do("HDEL", group, "_")
-	return nil, nil
+	limits.expire = now.Add(time.Duration(util.GetInt(o.Options, RGROUP_LIMITS_TTL, "group_limits_ttl")) * time.Second)
+	o.gmutex.Lock()
+	if o.limits == nil {
+		o.limits = make(map[string]rgroupLimits)
+	}
+	o.limits[gkey] = limits
+	o.gmutex.Unlock()
+	return limits, nil
+}
+
+// KEYS[1] = group, ARGV = field, value, maxfields, HSET | HSETNX, ttl
+// the ttl is set when the write creates the group hash
+const _rhsetgroupSrc = `
+local max = tonumber(ARGV[3])
+local len = redis.call('HLEN', KEYS[1])
+if max > 0 and len >= max and redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return redis.error_reply('group ' .. KEYS[1] .. ' reached max fields ' .. ARGV[3])
+end
+local ret = redis.call(ARGV[4], KEYS[1], ARGV[1], ARGV[2])
+local ttl = tonumber(ARGV[5])
+if ttl > 0 and len == 0 then
+	redis.call('EXPIRE', KEYS[1], ttl)
+end
+return ret
+`
+
+var _rhsetgroup = redis.NewScript(1, _rhsetgroupSrc)
+
+// risMeta tells the group meta hashes apart from user keys
+func risMeta(key string) bool {
+	return strings.HasPrefix(key, GROUP_META_PREFIX)
+}
+
+// rdropMeta filters the group meta hashes out of a key listing
+func rdropMeta(keys []string) []string {
+	var n = 0
+	for _, key := range keys {
+		if !risMeta(key) {
+			keys[n] = key
+			n++
+		}
+	}
+	return keys[:n]
 }
 
 func (o *DaoRedis) GetDB(db string, opt qdao.QOpt) (interface{}, error) {
-	panic("implement")
+	var rdb = o.DBMapping[db]
+	if rdb == nil {
+		rdb = 0
+	}
+	var index = util.AsInt(rdb, 0)
+	var conn = o.GetConn(db)
+	defer conn.Close()
+
+	keycount, err := redis.Int64(conn.Do("DBSIZE"))
+	if err != nil {
+		return nil, err
+	}
+	keyspace, err := redis.String(conn.Do("INFO", "keyspace"))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := redis.String(conn.Do("INFO", "memory"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret = map[string]interface{}{
+		"name":    db,
+		"index":   index,
+		"keys":    keycount,
+		"expires": int64(0),
+		"avg_ttl": int64(0),
+	}
+	var dbinfo = RParseInfo(keyspace)["db"+strconv.Itoa(index)]
+	if len(dbinfo) > 0 {
+		for _, kv := range strings.Split(dbinfo, ",") {
+			var pair = strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 {
+				continue
+			}
+			var n, _ = strconv.ParseInt(pair[1], 10, 64)
+			ret[pair[0]] = n
+		}
+	}
+	// redis does not account memory per logical db, this is the whole instance
+	var meminfo = RParseInfo(memory)
+	var used, _ = strconv.ParseInt(meminfo["used_memory"], 10, 64)
+	ret["instance_memory"] = used
+	ret["instance_memory_human"] = meminfo["used_memory_human"]
+	return ret, nil
 }
 
 func (o *DaoRedis) GetGroup(db string, group string, opt qdao.QOpt) (interface{}, error) {
-	panic("implement")
+	var conn = o.GetConn(db)
+	defer conn.Close()
+	// a group declared by UpdateGroup exists before its first field, as for ExistGroup
+	exists, err := redis.Int(conn.Do("EXISTS", group, GROUP_META_PREFIX+group))
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, nil
+	}
+
+	conn.Send("HLEN", group)
+	conn.Send("OBJECT", "ENCODING", group)
+	conn.Send("TTL", group)
+	conn.Send("MEMORY", "USAGE", group)
+	conn.Send("HGETALL", GROUP_META_PREFIX+group)
+	conn.Flush()
+
+	fields, err := redis.Int64(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	encoding, err := redis.String(conn.Receive())
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	ttl, err := redis.Int64(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	// MEMORY USAGE is not available before redis 4
+	memory, merr := redis.Int64(conn.Receive())
+	if merr != nil {
+		memory = -1
+	}
+	meta, err := redis.StringMap(conn.Receive())
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"name":     group,
+		"db":       db,
+		"fields":   fields,
+		"encoding": encoding,
+		"ttl":      ttl,
+		"memory":   memory,
+		"meta":     meta,
+	}, nil
 }
 
 func (o *DaoRedis) Exists(db string, group string, ids []interface{}) (int64, error) {
 	var conn = o.GetConn(db)
+	defer conn.Close()
 	if len(group) == 0 {
 		var count, err = redis.Int(conn.Do("EXISTS", ids...))
 		return int64(count), err
@@ -176,6 +480,7 @@ func (o *DaoRedis) Exists(db string, group string, ids []interface{}) (int64, er
 		for _, id := range ids {
 			conn.Send("HEXISTS", group, id)
 		}
+		conn.Flush()
 		var count int
 		var err error
 		var total int64 = 0
@@ -195,14 +500,18 @@ func (o *DaoRedis) ExistDB(db string) (bool, error) {
 
 func (o *DaoRedis) ExistGroup(db string, group string) (bool, error) {
 	var conn = o.GetConn(db)
-	var r, err = redis.Strings(conn.Do("KEYS", group))
+	defer conn.Close()
+	var count, err = redis.Int(conn.Do("EXISTS", group, GROUP_META_PREFIX+group))
 	if err != nil {
 		return false, err
 	}
-	return len(r) > 0, nil
+	return count > 0, nil
 }
 
 func (o *DaoRedis) GetConn(db string) redis.Conn {
+	if o.cluster != nil {
+		return o.cluster.Conn(o.keyPrefix(db))
+	}
 	var conn = o.pool.Get()
 	var rdb = o.DBMapping[db]
 	if rdb == nil {
@@ -212,17 +521,64 @@ func (o *DaoRedis) GetConn(db string) redis.Conn {
 	return conn
 }
 
+func (o *DaoRedis) getConnContext(ctx context.Context, db string, readonly bool) (redis.Conn, error) {
+	if o.cluster != nil {
+		return o.cluster.Conn(o.keyPrefix(db)), nil
+	}
+	var pool = o.pool
+	if readonly && o.rpool != nil {
+		pool = o.rpool
+	}
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rdb = o.DBMapping[db]
+	if rdb == nil {
+		rdb = 0
+	}
+	if _, err = RDo(ctx, conn, "SELECT", rdb); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// keyPrefix stands in for the DBMapping database index in cluster mode
+func (o *DaoRedis) keyPrefix(db string) string {
+	var rdb = o.DBMapping[db]
+	if rdb == nil {
+		return ""
+	}
+	var prefix = fmt.Sprint(rdb)
+	if len(prefix) == 0 || prefix == "0" {
+		return ""
+	}
+	if util.GetBool(o.Options, false, "cluster_hashtag") {
+		return "{" + prefix + "}:"
+	}
+	return prefix + ":"
+}
+
 func (o *DaoRedis) Get(db string, group string, id interface{}, unmarshal int, opt qdao.QOpt) (ret interface{}, err error) {
-	var conn = o.GetConn(db)
+	return o.GetContext(context.Background(), db, group, id, unmarshal, opt)
+}
+
+func (o *DaoRedis) GetContext(ctx context.Context, db string, group string, id interface{}, unmarshal int, opt qdao.QOpt) (ret interface{}, err error) {
+	conn, err := o.getConnContext(ctx, db, true)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	if len(group) == 0 {
-		ret, err = redis.StringMap(conn.Do("HGETALL", id))
+		ret, err = redis.StringMap(RDo(ctx, conn, "HGETALL", id))
 		if err == redis.ErrNil {
 			ret = nil
 			err = nil
 		}
 	} else {
 		var sret string
-		sret, err = redis.String(conn.Do("HGET", group, id))
+		sret, err = redis.String(RDo(ctx, conn, "HGET", group, id))
 		if err == nil {
 			ret = sret
 		} else {
@@ -244,8 +600,16 @@ func (o *DaoRedis) Get(db string, group string, id interface{}, unmarshal int, o
 }
 
 func (o *DaoRedis) Gets(db string, group string, ids []interface{}, unmarshal int, opt qdao.QOpt) (rets []interface{}, err error) {
+	return o.GetsContext(context.Background(), db, group, ids, unmarshal, opt)
+}
+
+func (o *DaoRedis) GetsContext(ctx context.Context, db string, group string, ids []interface{}, unmarshal int, opt qdao.QOpt) (rets []interface{}, err error) {
 	var retscount = 0
-	var conn = o.GetConn(db)
+	conn, err := o.getConnContext(ctx, db, true)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	var idslen = len(ids)
 	rets = make([]interface{}, idslen)
 
@@ -269,7 +633,7 @@ func (o *DaoRedis) Gets(db string, group string, ids []interface{}, unmarshal in
 
 	conn.Flush()
 	for i := 0; i < idslen; i++ {
-		var one, oneerr = conn.Receive()
+		var one, oneerr = RReceive(ctx, conn)
 		if oneerr == redis.ErrNil {
 			continue
 		}
@@ -294,17 +658,25 @@ func (o *DaoRedis) Gets(db string, group string, ids []interface{}, unmarshal in
 }
 
 func (o *DaoRedis) List(db string, group string, from int, size int, unmarshal int, opt qdao.QOpt) (rets []interface{}, cursor int, err error) {
+	return o.ListContext(context.Background(), db, group, from, size, unmarshal, opt)
+}
+
+func (o *DaoRedis) ListContext(ctx context.Context, db string, group string, from int, size int, unmarshal int, opt qdao.QOpt) (rets []interface{}, cursor int, err error) {
 
 	if size <= 0 {
 		size = 1
 	}
 
 	var reply interface{}
-	var conn = o.GetConn(db)
+	conn, err := o.getConnContext(ctx, db, true)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer conn.Close()
 	if len(group) == 0 {
-		reply, err = conn.Do("SCAN", from, "COUNT", size)
+		reply, err = RDo(ctx, conn, "SCAN", from, "COUNT", size)
 	} else {
-		reply, err = conn.Do("HSCAN", group, from, "COUNT", size)
+		reply, err = RDo(ctx, conn, "HSCAN", group, from, "COUNT", size)
 	}
 	if err != nil {
 		return nil, -1, err
@@ -312,6 +684,9 @@ func (o *DaoRedis) List(db string, group string, from int, size int, unmarshal i
 	var bulk, _ = redis.Values(reply, err)
 	var keyvals, _ = redis.Strings(bulk[1], err)
 	cursor, _ = redis.Int(bulk[0], err)
+	if len(group) == 0 {
+		keyvals = rdropMeta(keyvals)
+	}
 	var keyvalslen = len(keyvals)
 	var data = make([]interface{}, keyvalslen>>1)
 	if keyvalslen == 0 {
@@ -340,22 +715,48 @@ func (o *DaoRedis) List(db string, group string, from int, size int, unmarshal i
 }
 
 func (o *DaoRedis) Keys(db string, group string, wildcard string, opt qdao.QOpt) (keys []string, err error) {
-	var conn = o.GetConn(db)
+	return o.KeysContext(context.Background(), db, group, wildcard, opt)
+}
+
+func (o *DaoRedis) KeysContext(ctx context.Context, db string, group string, wildcard string, opt qdao.QOpt) (keys []string, err error) {
+	conn, err := o.getConnContext(ctx, db, true)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	if len(group) == 0 {
 		conn.Send("KEYS", wildcard)
 	} else {
 		conn.Send("HKEYS", group)
 	}
 	conn.Flush()
-	return redis.Strings(conn.Receive())
+	keys, err = redis.Strings(RReceive(ctx, conn))
+	if err != nil || len(group) > 0 {
+		return keys, err
+	}
+	return rdropMeta(keys), nil
 }
 
 func (o *DaoRedis) Query(db string, query string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
-	panic("implement me")
+	q, err := RParseQuery(query, args)
+	if err != nil {
+		return nil, err
+	}
+	var conn = o.GetConn(db)
+	defer conn.Close()
+	return q.run(conn)
 }
 
 func (o *DaoRedis) Update(db string, group string, id interface{}, val interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
-	var conn = o.GetConn(db)
+	return o.UpdateContext(context.Background(), db, group, id, val, override, marshal, opt)
+}
+
+func (o *DaoRedis) UpdateContext(ctx context.Context, db string, group string, id interface{}, val interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
+	conn, err := o.getConnContext(ctx, db, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	if marshal > 0 {
 		bytes, err := json.Marshal(val)
 		if err != nil {
@@ -366,7 +767,7 @@ func (o *DaoRedis) Update(db string, group string, id interface{}, val interface
 	if len(group) == 0 {
 		if qref.IsMapOrStruct(val) {
 			var args = redis.Args{}.Add(id).AddFlat(val)
-			return redis.String(conn.Do("HMSET", args...))
+			return redis.String(RDo(ctx, conn, "HMSET", args...))
 		} else {
 			if marshal < 0 {
 				sval, err := qref.MarshalLazy(val)
@@ -376,9 +777,9 @@ func (o *DaoRedis) Update(db string, group string, id interface{}, val interface
 				val = sval
 			}
 			if override {
-				return redis.String(conn.Do("SET", id, val))
+				return redis.String(RDo(ctx, conn, "SET", id, val))
 			} else {
-				return redis.Int(conn.Do("SETNX", id, val))
+				return redis.Int(RDo(ctx, conn, "SETNX", id, val))
 			}
 		}
 	} else {
@@ -389,13 +790,19 @@ func (o *DaoRedis) Update(db string, group string, id interface{}, val interface
 			}
 			val = sval
 		}
+		var cmd = "HSETNX"
 		if override {
-			return redis.Int(conn.Do("HSET", group, id, val))
-		} else {
-			return redis.Int(conn.Do("HSETNX", group, id, val))
+			cmd = "HSET"
+		}
+		limits, err := o.groupLimits(conn, db, group)
+		if err != nil {
+			return nil, err
+		}
+		if limits.maxfields > 0 || limits.ttl > 0 {
+			return redis.Int(_rhsetgroup.DoContext(ctx, conn, group, id, val, limits.maxfields, cmd, limits.ttl))
 		}
+		return redis.Int(RDo(ctx, conn, cmd, group, id, val))
 	}
-	return nil, nil
 }
 
 func (o *DaoRedis) Updates(db string, group string, ids []interface{}, vals []interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
@@ -405,12 +812,26 @@ func (o *DaoRedis) Updates(db string, group string, ids []interface{}, vals []in
 
 func (o *DaoRedis) UpdateBatch(db string, groups []string, ids []interface{}, vals []interface{}, override bool, marshal int, opt qdao.UOpt) (interface{}, error) {
 	var conn = o.GetConn(db)
+	defer conn.Close()
 	var idslen = len(ids)
 	var valslen = len(vals)
 	if idslen != valslen {
 		return nil, fmt.Errorf("ids len != valslen, %d != %d", idslen, valslen)
 	}
 
+	// resolved before pipelining, a Do in between would consume pending replies
+	var glimits = make(map[string]rgroupLimits)
+	for _, group := range groups {
+		if _, ok := glimits[group]; ok || len(group) == 0 {
+			continue
+		}
+		limits, err := o.groupLimits(conn, db, group)
+		if err != nil {
+			return nil, err
+		}
+		glimits[group] = limits
+	}
+
 	for i := 0; i < idslen; i++ {
 		var id = ids[i]
 		var group = groups[i]
@@ -449,10 +870,14 @@ func (o *DaoRedis) UpdateBatch(db string, groups []string, ids []interface{}, va
 				}
 				val = sval
 			}
+			var cmd = "HSETNX"
 			if override {
-				conn.Send("HSET", group, id, val)
+				cmd = "HSET"
+			}
+			if limits := glimits[group]; limits.maxfields > 0 || limits.ttl > 0 {
+				_rhsetgroup.Send(conn, group, id, val, limits.maxfields, cmd, limits.ttl)
 			} else {
-				conn.Send("HSETNX", group, id, val)
+				conn.Send(cmd, group, id, val)
 			}
 		}
 	}
@@ -474,18 +899,27 @@ func (o *DaoRedis) UpdateBatch(db string, groups []string, ids []interface{}, va
 }
 
 func (o *DaoRedis) Delete(db string, group string, id interface{}, opt qdao.DOpt) (interface{}, error) {
-	var conn = o.GetConn(db)
+	return o.DeleteContext(context.Background(), db, group, id, opt)
+}
+
+func (o *DaoRedis) DeleteContext(ctx context.Context, db string, group string, id interface{}, opt qdao.DOpt) (interface{}, error) {
+	conn, err := o.getConnContext(ctx, db, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	if len(group) == 0 {
 		conn.Send("DEL", id)
 	} else {
 		conn.Send("HDEL", group, id)
 	}
 	conn.Flush()
-	return redis.Int(conn.Receive())
+	return redis.Int(RReceive(ctx, conn))
 }
 
 func (o *DaoRedis) Deletes(db string, group string, ids []interface{}, opt qdao.DOpt) (interface{}, error) {
 	var conn = o.GetConn(db)
+	defer conn.Close()
 	if len(group) == 0 {
 		conn.Send("DEL", ids...)
 	} else {
@@ -496,47 +930,214 @@ func (o *DaoRedis) Deletes(db string, group string, ids []interface{}, opt qdao.
 	return redis.Int(conn.Receive())
 }
 
+// ScanAsMap returns field -> value of a group page, or key -> value of a keyspace page,
+// nil for the keys that hold no string
 func (o *DaoRedis) ScanAsMap(db string, group string, from int, size int, unmarshal int, query ...interface{}) (ret map[string]interface{}, cursor int, total int, err error) {
 	var conn = o.GetConn(db)
-	var cmd string
-	if len(group) == 0 {
-		cmd = "SCAN"
-	} else {
-		cmd = "HSCAN"
-
+	defer conn.Close()
+	var hscan = len(group) > 0
+	var args = redis.Args{}
+	if hscan {
+		args = args.Add(group)
 	}
-	if query == nil {
-		conn.Send(cmd, from)
+	args = append(args, RScanArgs(from, size, query...)...)
+
+	var reply interface{}
+	if hscan {
+		reply, err = conn.Do("HSCAN", args...)
 	} else {
-		conn.Send(cmd, append([]interface{}{from}, query...)...)
+		reply, err = conn.Do("SCAN", args...)
+	}
+	bulks, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	cursor, _ = redis.Int(bulks[0], nil)
+	if cursor == 0 {
+		cursor = -1
+	}
+
+	if hscan {
+		mss, err := redis.StringMap(bulks[1], nil)
+		if err != nil {
+			return nil, cursor, 0, err
+		}
+		ret = make(map[string]interface{}, len(mss))
+		for k, v := range mss {
+			ret[k] = v
+		}
+		return ret, cursor, 0, nil
 	}
 
-	raw, err := conn.Receive()
+	keys, err := redis.Strings(bulks[1], nil)
+	if err != nil {
+		return nil, cursor, 0, err
+	}
+	keys = rdropMeta(keys)
+	ret = make(map[string]interface{}, len(keys))
+	if len(keys) == 0 {
+		return ret, cursor, 0, nil
+	}
+	vals, err := redis.Values(conn.Do("MGET", redis.Args{}.AddFlat(keys)...))
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, cursor, 0, err
 	}
-	bulks, err := redis.Values(raw, err)
-	cursor, _ = redis.Int(bulks[0], err)
-	mss, _ := redis.StringMap(bulks[1], err)
-	m := util.AsMap(mss, false)
-	return m, len(m), 0, err
+	for i, key := range keys {
+		if bytes, ok := vals[i].([]byte); ok {
+			ret[key] = string(bytes)
+		} else {
+			ret[key] = nil
+		}
+	}
+	return ret, cursor, 0, nil
 }
 
 func (o *DaoRedis) Scan(db string, group string, from int, size int, unmarshal int, query ...interface{}) (ret []interface{}, cursor int, total int, err error) {
+	return o.ScanContext(context.Background(), db, group, from, size, unmarshal, query...)
+}
 
-	//for k, v := range m {
-	//
-	//}
-	//return ret, cursor, len(m), err;
-	return nil, 0, 0, nil
+func (o *DaoRedis) ScanContext(ctx context.Context, db string, group string, from int, size int, unmarshal int, query ...interface{}) (ret []interface{}, cursor int, total int, err error) {
+	if from < 0 {
+		return nil, -1, 0, nil
+	}
+	conn, err := o.getConnContext(ctx, db, false)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	defer conn.Close()
+	var hscan = len(group) > 0
+	var args = redis.Args{}
+	if hscan {
+		args = args.Add(group)
+	}
+	args = append(args, RScanArgs(from, size, query...)...)
+
+	var reply interface{}
+	if hscan {
+		reply, err = RDo(ctx, conn, "HSCAN", args...)
+	} else {
+		reply, err = RDo(ctx, conn, "SCAN", args...)
+	}
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	bulks, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	cursor, _ = redis.Int(bulks[0], nil)
+	if cursor == 0 {
+		cursor = -1
+	}
+
+	if hscan {
+		total, err = redis.Int(RDo(ctx, conn, "HLEN", group))
+	} else {
+		total, err = redis.Int(RDo(ctx, conn, "DBSIZE"))
+	}
+	if err != nil {
+		return nil, cursor, 0, err
+	}
+
+	if hscan {
+		keyvals, err := redis.Strings(bulks[1], nil)
+		if err != nil {
+			return nil, cursor, total, err
+		}
+		var keyvalslen = len(keyvals)
+		ret = make([]interface{}, keyvalslen>>1)
+		for n, i := 0, 0; i < keyvalslen; n, i = n+1, i+2 {
+			var key = keyvals[i]
+			var val = keyvals[i+1]
+			if unmarshal == 0 {
+				ret[n] = val
+			} else {
+				var m map[string]interface{}
+				if err = json.Unmarshal([]byte(val), &m); err != nil {
+					return nil, cursor, total, err
+				}
+				if m == nil {
+					m = make(map[string]interface{})
+				}
+				m["id"] = key
+				ret[n] = m
+			}
+		}
+		return ret, cursor, total, nil
+	}
+
+	keys, err := redis.Strings(bulks[1], nil)
+	if err != nil {
+		return nil, cursor, total, err
+	}
+	keys = rdropMeta(keys)
+	var keyslen = len(keys)
+	for _, key := range keys {
+		conn.Send("HGETALL", key)
+	}
+	conn.Flush()
+	ret = make([]interface{}, keyslen)
+	var plains []int
+	for i := 0; i < keyslen; i++ {
+		var mss, rerr = redis.StringMap(RReceive(ctx, conn))
+		if rerr != nil {
+			if _, wrongtype := rerr.(redis.Error); wrongtype {
+				plains = append(plains, i)
+				continue
+			}
+			return nil, cursor, total, rerr
+		}
+		if unmarshal == 0 {
+			ret[i] = mss
+		} else {
+			var m = make(map[string]interface{}, len(mss)+1)
+			for k, v := range mss {
+				m[k] = v
+			}
+			m["id"] = keys[i]
+			ret[i] = m
+		}
+	}
+
+	// keys that are not hashes are read as plain values
+	for _, i := range plains {
+		var val, rerr = redis.String(RDo(ctx, conn, "GET", keys[i]))
+		if rerr != nil {
+			if rerr == redis.ErrNil {
+				continue
+			}
+			return nil, cursor, total, rerr
+		}
+		if unmarshal == 0 {
+			ret[i] = val
+		} else {
+			var m map[string]interface{}
+			if err = json.Unmarshal([]byte(val), &m); err != nil {
+				return nil, cursor, total, err
+			}
+			if m == nil {
+				m = make(map[string]interface{})
+			}
+			m["id"] = keys[i]
+			ret[i] = m
+		}
+	}
+	return ret, cursor, total, nil
 }
 
 func (o *DaoRedis) Script(db string, group string, id interface{}, script string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
-	var conn = o.GetConn(db)
+	return o.ScriptContext(context.Background(), db, group, id, script, args, opt)
+}
+
+func (o *DaoRedis) ScriptContext(ctx context.Context, db string, group string, id interface{}, script string, args []interface{}, opt qdao.QOpt) (interface{}, error) {
+	conn, err := o.getConnContext(ctx, db, false)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
 	var keycount int = 0
 	if args != nil {
 		keycount = len(args)
 	}
-	var rscript = redis.NewScript(keycount, script)
-	return redis.String(rscript.Do(conn, redis.Args{}.AddFlat(args)...))
+	return redis.String(redis.NewScript(keycount, script).DoContext(ctx, conn, redis.Args{}.AddFlat(args)...))
 }
@@ -0,0 +1,1066 @@
+package qredis
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	lua "github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standin is a tls redis stand-in that understands just enough RESP for AUTH, SELECT and PING.
+// other commands go to handle, asking tells whether ASKING came right before on the connection
+type standin struct {
+	listener net.Listener
+	user     string
+	pass     string
+	mutex    sync.Mutex
+	auths    [][]string
+	handle   func(args []string, asking bool) string
+}
+
+// newTCPStandin is a plain tcp stand-in answering through handle
+func newTCPStandin(t *testing.T, handle func(args []string, asking bool) string) *standin {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &standin{listener: listener, handle: handle}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standin) addr() string {
+	return s.listener.Addr().String()
+}
+
+func newStandin(t *testing.T, cert tls.Certificate, user string, pass string) *standin {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s = &standin{listener: listener, user: user, pass: pass}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standin) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *standin) serve(conn net.Conn) {
+	defer conn.Close()
+	var reader = bufio.NewReader(conn)
+	var asking = false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "*") {
+			return
+		}
+		var n, _ = strconv.Atoi(strings.TrimSpace(line[1:]))
+		var args = make([]string, n)
+		for i := 0; i < n; i++ {
+			head, err := reader.ReadString('\n')
+			if err != nil || !strings.HasPrefix(head, "$") {
+				return
+			}
+			// bulk strings are read by length, scripts carry line breaks
+			var size, _ = strconv.Atoi(strings.TrimSpace(head[1:]))
+			var arg = make([]byte, size+2)
+			if _, err = io.ReadFull(reader, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			s.mutex.Lock()
+			s.auths = append(s.auths, args)
+			s.mutex.Unlock()
+			if len(args) == 3 && args[1] == s.user && args[2] == s.pass {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case "PING":
+			reply = "+PONG\r\n"
+		case "SELECT", "ASKING":
+			reply = "+OK\r\n"
+		default:
+			if s.handle != nil {
+				reply = s.handle(args, asking)
+			} else {
+				reply = "-ERR unknown command\r\n"
+			}
+		}
+		asking = strings.ToUpper(args[0]) == "ASKING"
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// newCert issues a self signed CA and a localhost server certificate, the CA is written to cafile
+func newCert(t *testing.T, cafile string) tls.Certificate {
+	cakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ca = &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "qdao test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, ca, ca, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ = x509.ParseCertificate(cader)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaf = &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafder, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var capem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cader})
+	if err = ioutil.WriteFile(cafile, capem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{leafder}, PrivateKey: key}
+}
+
+func TestTLSAndACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cafile = filepath.Join(dir, "ca.pem")
+	var cert = newCert(t, cafile)
+	var server = newStandin(t, cert, "camsi", "secret")
+	defer server.listener.Close()
+
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "localhost", server.port(), "camsi", "secret", "0", map[string]interface{}{
+		"tls":    true,
+		"tls_ca": cafile,
+	})
+	defer dao.Close()
+	if _, err = dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	server.mutex.Lock()
+	var auths = fmt.Sprint(server.auths)
+	server.mutex.Unlock()
+	if auths != "[[AUTH camsi secret]]" {
+		t.Fatalf("unexpected auth %s", auths)
+	}
+
+	// a CA that did not sign the server certificate must be refused
+	var othercafile = filepath.Join(dir, "other.pem")
+	newCert(t, othercafile)
+	var other = &DaoRedis{}
+	other.Configure("test", "redis", "localhost", server.port(), "camsi", "secret", "0", map[string]interface{}{
+		"tls":    true,
+		"tls_ca": othercafile,
+	})
+	defer other.Close()
+	if _, err = other.Conn(); err == nil {
+		t.Fatal("expect certificate verification failure")
+	}
+}
+
+func TestConnReturned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cafile = filepath.Join(dir, "ca.pem")
+	var server = newStandin(t, newCert(t, cafile), "", "")
+	defer server.listener.Close()
+
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "localhost", server.port(), "", "", "0", map[string]interface{}{
+		"tls":        true,
+		"tls_ca":     cafile,
+		"max_active": 1,
+	})
+	defer dao.Close()
+	if _, err = dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	// with a single connection allowed, any leak exhausts the pool
+	for i := 0; i < 3; i++ {
+		if !dao.IsConnected() {
+			t.Fatal("pool exhausted")
+		}
+		if err = dao.SelectDB("default"); err != nil {
+			t.Fatal(err)
+		}
+		dao.Keys("default", "", "*", nil)
+	}
+	if active, idle := dao.pool.ActiveCount(), dao.pool.IdleCount(); active != idle {
+		t.Fatalf("%d connections open, %d idle", active, idle)
+	}
+}
+
+func TestRLogArgs(t *testing.T) {
+	if s := RLogArgs("AUTH", []interface{}{"camsi", "secret"}); s != "AUTH [REDACTED]" {
+		t.Fatalf("credentials leaked, %s", s)
+	}
+	if s := RLogArgs("HSET", []interface{}{"group", []byte("id"), 1}); s != "HSET group id 1" {
+		t.Fatalf("unexpected %s", s)
+	}
+	var long = strings.Repeat("x", RLOG_ARG_MAX+10)
+	if s := RLogArgs("SET", []interface{}{"k", long}); s != "SET k "+long[:RLOG_ARG_MAX]+"...(74)" {
+		t.Fatalf("unexpected %s", s)
+	}
+}
+
+func TestRDoCancel(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	conn, err := redis.Dial("tcp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// no deadline, the cancellation alone has to get through
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	var start = time.Now()
+	if _, err = RDo(ctx, &RLogConn{Conn: conn, Logger: &rtestLogger{t: t}, Errors: true}, "BLPOP", "q", 0); err != context.Canceled {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+	if took := time.Since(start); took > 150*time.Millisecond {
+		t.Fatalf("cancellation took %v", took)
+	}
+}
+
+// rtestLogger collects the lines logged
+type rtestLogger struct {
+	t     *testing.T
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *rtestLogger) Printf(format string, v ...interface{}) {
+	var line = fmt.Sprintf(format, v...)
+	l.t.Log(line)
+	l.mutex.Lock()
+	l.lines = append(l.lines, line)
+	l.mutex.Unlock()
+}
+
+// rtestStatus is a simple string reply of rtestStore
+type rtestStatus string
+
+// rtestStore is the keyspace behind rtestServer: strings and hashes, ttls as set and
+// scripts run through gopher-lua. exec answers nil, string, rtestStatus, int64,
+// []interface{} or redis.Error, every command run, scripted ones included, is kept in log
+type rtestStore struct {
+	strs     map[string]string
+	hashes   map[string]map[string]string
+	ttls     map[string]int64
+	scripts  map[string]string
+	readonly bool
+	log      [][]string
+}
+
+var rtestWrites = map[string]bool{
+	"SET": true, "DEL": true, "EXPIRE": true, "PERSIST": true,
+	"HSET": true, "HSETNX": true, "HMSET": true, "HDEL": true,
+}
+
+func newRTestStore() *rtestStore {
+	return &rtestStore{
+		strs:    map[string]string{},
+		hashes:  map[string]map[string]string{},
+		ttls:    map[string]int64{},
+		scripts: map[string]string{},
+	}
+}
+
+// calls returns the commands named cmd run so far, args joined by spaces
+func (s *rtestStore) calls(cmd string) []string {
+	var calls []string
+	for _, args := range s.log {
+		if strings.EqualFold(args[0], cmd) {
+			calls = append(calls, strings.Join(args, " "))
+		}
+	}
+	return calls
+}
+
+func (s *rtestStore) keys() []string {
+	var keys []string
+	for k := range s.strs {
+		keys = append(keys, k)
+	}
+	for k := range s.hashes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *rtestStore) exists(key string) bool {
+	var _, str = s.strs[key]
+	var _, hash = s.hashes[key]
+	return str || hash
+}
+
+func (s *rtestStore) del(key string) int64 {
+	if !s.exists(key) {
+		return 0
+	}
+	delete(s.strs, key)
+	delete(s.hashes, key)
+	delete(s.ttls, key)
+	return 1
+}
+
+func (s *rtestStore) hash(key string) map[string]string {
+	var h = s.hashes[key]
+	if h == nil {
+		h = map[string]string{}
+		s.hashes[key] = h
+	}
+	return h
+}
+
+func rtestGlob(pattern string) *regexp.Regexp {
+	var expr = regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// scan pages through names as SCAN does, args are cursor [MATCH pattern] [COUNT count]
+func rtestScan(names []string, args []string) ([]string, string) {
+	var cursor, _ = strconv.Atoi(args[0])
+	var count = 10
+	var match *regexp.Regexp
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = rtestGlob(args[i+1])
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	var page []string
+	var next = cursor
+	for ; next < len(names) && next < cursor+count; next++ {
+		if match == nil || match.MatchString(names[next]) {
+			page = append(page, names[next])
+		}
+	}
+	if next >= len(names) {
+		return page, "0"
+	}
+	return page, strconv.Itoa(next)
+}
+
+func rtestStrings(vals []string) []interface{} {
+	var rets = make([]interface{}, len(vals))
+	for i, v := range vals {
+		rets[i] = v
+	}
+	return rets
+}
+
+func (s *rtestStore) exec(args []string) interface{} {
+	var cmd = strings.ToUpper(args[0])
+	if s.readonly && rtestWrites[cmd] {
+		return redis.Error("READONLY You can't write against a read only replica.")
+	}
+	s.log = append(s.log, args)
+	if len(args) > 1 {
+		var _, str = s.strs[args[1]]
+		var _, hash = s.hashes[args[1]]
+		if (str && cmd[0] == 'H') || (hash && cmd == "GET") {
+			return redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+	}
+	switch cmd {
+	case "GET":
+		if v, ok := s.strs[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		s.del(args[1])
+		s.strs[args[1]] = args[2]
+		return rtestStatus("OK")
+	case "MGET":
+		var rets = make([]interface{}, len(args)-1)
+		for i, key := range args[1:] {
+			if v, ok := s.strs[key]; ok {
+				rets[i] = v
+			}
+		}
+		return rets
+	case "DEL", "EXISTS":
+		var n int64
+		for _, key := range args[1:] {
+			if cmd == "DEL" {
+				n += s.del(key)
+			} else if s.exists(key) {
+				n++
+			}
+		}
+		return n
+	case "EXPIRE":
+		if !s.exists(args[1]) {
+			return int64(0)
+		}
+		s.ttls[args[1]], _ = strconv.ParseInt(args[2], 10, 64)
+		return int64(1)
+	case "PERSIST":
+		if _, ok := s.ttls[args[1]]; !ok {
+			return int64(0)
+		}
+		delete(s.ttls, args[1])
+		return int64(1)
+	case "TTL":
+		if !s.exists(args[1]) {
+			return int64(-2)
+		}
+		if ttl, ok := s.ttls[args[1]]; ok {
+			return ttl
+		}
+		return int64(-1)
+	case "DBSIZE":
+		return int64(len(s.keys()))
+	case "KEYS":
+		var match = rtestGlob(args[1])
+		var keys = []string{}
+		for _, key := range s.keys() {
+			if match.MatchString(key) {
+				keys = append(keys, key)
+			}
+		}
+		return rtestStrings(keys)
+	case "SCAN":
+		var page, next = rtestScan(s.keys(), args[1:])
+		return []interface{}{next, rtestStrings(page)}
+	case "INFO":
+		if strings.EqualFold(args[1], "memory") {
+			return "# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\n"
+		}
+		return fmt.Sprintf("# Keyspace\r\ndb0:keys=%d,expires=%d,avg_ttl=0\r\n", len(s.keys()), len(s.ttls))
+	case "OBJECT", "MEMORY":
+		var h, ok = s.hashes[args[2]]
+		if !ok {
+			return nil
+		}
+		if cmd == "OBJECT" {
+			return "listpack"
+		}
+		return int64(64 * (len(h) + 1))
+	case "HGET":
+		if v, ok := s.hashes[args[1]][args[2]]; ok {
+			return v
+		}
+		return nil
+	case "HSET", "HSETNX", "HMSET":
+		var h = s.hash(args[1])
+		var n int64
+		for i := 2; i+1 < len(args); i += 2 {
+			var _, exist = h[args[i]]
+			if exist && cmd == "HSETNX" {
+				continue
+			}
+			if !exist {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		if cmd == "HMSET" {
+			return rtestStatus("OK")
+		}
+		return n
+	case "HMGET":
+		var rets = make([]interface{}, len(args)-2)
+		for i, field := range args[2:] {
+			if v, ok := s.hashes[args[1]][field]; ok {
+				rets[i] = v
+			}
+		}
+		return rets
+	case "HGETALL", "HSCAN":
+		var h = s.hashes[args[1]]
+		var fields []string
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		var next = "0"
+		if cmd == "HSCAN" {
+			fields, next = rtestScan(fields, args[2:])
+		}
+		var kvs = []interface{}{}
+		for _, field := range fields {
+			kvs = append(kvs, field, h[field])
+		}
+		if cmd == "HSCAN" {
+			return []interface{}{next, kvs}
+		}
+		return kvs
+	case "HLEN":
+		return int64(len(s.hashes[args[1]]))
+	case "HEXISTS":
+		if _, ok := s.hashes[args[1]][args[2]]; ok {
+			return int64(1)
+		}
+		return int64(0)
+	case "HDEL":
+		var n int64
+		for _, field := range args[2:] {
+			if _, ok := s.hashes[args[1]][field]; ok {
+				delete(s.hashes[args[1]], field)
+				n++
+			}
+		}
+		if len(s.hashes[args[1]]) == 0 {
+			s.del(args[1])
+		}
+		return n
+	case "EVAL", "EVALSHA":
+		var src = args[1]
+		if cmd == "EVALSHA" {
+			var ok bool
+			if src, ok = s.scripts[args[1]]; !ok {
+				return redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+			}
+		} else {
+			s.scripts[fmt.Sprintf("%x", sha1.Sum([]byte(src)))] = src
+		}
+		var numkeys, _ = strconv.Atoi(args[2])
+		return s.eval(src, args[3:3+numkeys], args[3+numkeys:])
+	}
+	return redis.Error("ERR unknown command " + args[0])
+}
+
+// eval runs a script the way redis does, with KEYS, ARGV, redis.call and cjson.decode
+func (s *rtestStore) eval(src string, keys []string, argv []string) interface{} {
+	var L = lua.NewState()
+	defer L.Close()
+	var strs = func(vals []string) *lua.LTable {
+		var t = L.NewTable()
+		for _, v := range vals {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+	L.SetGlobal("KEYS", strs(keys))
+	L.SetGlobal("ARGV", strs(argv))
+
+	var call = func(protected bool) lua.LGFunction {
+		return func(L *lua.LState) int {
+			var args = make([]string, L.GetTop())
+			for i := range args {
+				args[i] = L.Get(i + 1).String()
+			}
+			var ret = s.exec(args)
+			if err, ok := ret.(redis.Error); ok && !protected {
+				L.RaiseError("%s", err.Error())
+				return 0
+			}
+			L.Push(rtestToLua(L, ret))
+			return 1
+		}
+	}
+	var reply = func(field string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			var t = L.NewTable()
+			t.RawSetString(field, lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		}
+	}
+	var rlib = L.NewTable()
+	L.SetFuncs(rlib, map[string]lua.LGFunction{
+		"call":         call(false),
+		"pcall":        call(true),
+		"error_reply":  reply("err"),
+		"status_reply": reply("ok"),
+	})
+	L.SetGlobal("redis", rlib)
+
+	var null = L.NewUserData()
+	var cjson = L.NewTable()
+	cjson.RawSetString("null", null)
+	cjson.RawSetString("decode", L.NewFunction(func(L *lua.LState) int {
+		var v interface{}
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		L.Push(rtestFromJSON(L, v, null))
+		return 1
+	}))
+	L.SetGlobal("cjson", cjson)
+
+	if err := L.DoString(src); err != nil {
+		var msg = err.Error()
+		if aerr, ok := err.(*lua.ApiError); ok {
+			msg = aerr.Object.String()
+		}
+		return redis.Error("ERR Error running script: " + msg)
+	}
+	return rtestFromLua(L.Get(-1))
+}
+
+// rtestToLua converts a reply to what redis.call returns
+func rtestToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case int64:
+		return lua.LNumber(v)
+	case rtestStatus:
+		var t = L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case redis.Error:
+		var t = L.NewTable()
+		t.RawSetString("err", lua.LString(v))
+		return t
+	case []interface{}:
+		var t = L.NewTable()
+		for _, one := range v {
+			t.Append(rtestToLua(L, one))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// rtestFromLua converts a script return value to its reply
+func rtestFromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return int64(v)
+	case lua.LBool:
+		if v {
+			return int64(1)
+		}
+	case *lua.LTable:
+		if err, ok := v.RawGetString("err").(lua.LString); ok {
+			return redis.Error(err)
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return rtestStatus(status)
+		}
+		var rets = []interface{}{}
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			rets = append(rets, rtestFromLua(v.RawGetInt(i)))
+		}
+		return rets
+	}
+	return nil
+}
+
+func rtestFromJSON(L *lua.LState, v interface{}, null lua.LValue) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return null
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		var t = L.NewTable()
+		for _, one := range v {
+			t.Append(rtestFromJSON(L, one, null))
+		}
+		return t
+	case map[string]interface{}:
+		var t = L.NewTable()
+		for k, one := range v {
+			t.RawSetString(k, rtestFromJSON(L, one, null))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// rtestReply encodes an rtestStore reply in RESP
+func rtestReply(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return rtestBulk(v)
+	case rtestStatus:
+		return "+" + string(v) + "\r\n"
+	case int64:
+		return fmt.Sprintf(":%d\r\n", v)
+	case redis.Error:
+		return "-" + string(v) + "\r\n"
+	case []interface{}:
+		var items = make([]string, len(v))
+		for i, one := range v {
+			items[i] = rtestReply(one)
+		}
+		return rtestArray(items...)
+	}
+	return "$-1\r\n"
+}
+
+func TestRLogConnPipeline(t *testing.T) {
+	var server = newRTestServer(t, "a", "slave")
+	defer server.listener.Close()
+	conn, err := redis.Dial("tcp", server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logger = &rtestLogger{t: t}
+	var c = &RLogConn{Conn: conn, Logger: logger, Errors: true, Slow: 100 * time.Millisecond}
+	defer c.Close()
+
+	c.Send("HGET", "g", "id")
+	c.Send("HSET", "g", "id", "v")
+	c.Send("BLPOP", "q", 0)
+	c.Flush()
+	for i := 0; i < 2; i++ {
+		c.Receive()
+	}
+	if _, err = redis.ReceiveWithTimeout(c, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	logger.mutex.Lock()
+	var lines = logger.lines
+	logger.mutex.Unlock()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "redis HSET g id v failed") || !strings.HasPrefix(lines[1], "redis slow BLPOP q 0") {
+		t.Fatalf("unexpected log %q", lines)
+	}
+}
+
+func TestScanAsMap(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "127.0.0.1", server.port(), "", "", "0", map[string]interface{}{
+		"max_active": 1,
+		"wait":       true,
+	})
+	defer dao.Close()
+	if _, err := dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	// with a single connection, a leak blocks the second scan
+	for i := 0; i < 2; i++ {
+		m, cursor, _, err := dao.ScanAsMap("default", "g", 0, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor != -1 || fmt.Sprint(m) != "map[id:a]" {
+			t.Fatalf("scan %v, cursor %d", m, cursor)
+		}
+	}
+	if hscans := server.calls("HSCAN"); hscans[0] != "HSCAN g 0 COUNT 10" {
+		t.Fatalf("hscans %q", hscans)
+	}
+
+	// keys with their values, the group meta hashes left out
+	server.data(func(store *rtestStore) {
+		store.strs["s1"] = "1"
+		store.strs["s2"] = "2"
+		store.hash(GROUP_META_PREFIX + "g")["ttl"] = "0"
+	})
+	m, cursor, _, err := dao.ScanAsMap("default", "", 0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != -1 || fmt.Sprint(m) != "map[g:<nil> s1:1 s2:2]" {
+		t.Fatalf("scan %v, cursor %d", m, cursor)
+	}
+	if m, _, _, err = dao.ScanAsMap("default", "", 0, 2, 0, "MATCH", "s*"); err != nil {
+		t.Fatal(err)
+	}
+	var scans = server.calls("SCAN")
+	if scans[1] != "SCAN 0 MATCH s* COUNT 2" || fmt.Sprint(m) != "map[]" {
+		t.Fatalf("scan %v, scans %q", m, scans)
+	}
+	if mgets := server.calls("MGET"); len(mgets) != 1 || mgets[0] != "MGET g s1 s2" {
+		t.Fatalf("mgets %q", mgets)
+	}
+}
+
+func newRTestDao(t *testing.T, server *rtestServer, options map[string]interface{}) *DaoRedis {
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "127.0.0.1", server.port(), "", "", "0", options)
+	if _, err := dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	return dao
+}
+
+func TestRUpdateGroup(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+
+	var limits = map[string]interface{}{"maxfields": 2, "ttl": 60}
+	if ok, err := dao.UpdateGroup("default", "users", limits, false, false, nil); err != nil || ok != false {
+		t.Fatalf("update of a missing group without create %v %v", ok, err)
+	}
+	if ok, err := dao.UpdateGroup("default", "users", limits, true, false, nil); err != nil || ok != true {
+		t.Fatalf("create %v %v", ok, err)
+	}
+	var meta map[string]string
+	server.data(func(store *rtestStore) { meta = store.hashes[GROUP_META_PREFIX+"users"] })
+	if meta["maxfields"] != "2" || meta["ttl"] != "60" || meta["created"] == "" {
+		t.Fatalf("meta %v", meta)
+	}
+
+	// the first write creates the hash and sets its ttl, the third field is refused
+	for _, id := range []string{"x", "y", "x"} {
+		if _, err := dao.Update("default", "users", id, "v", true, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expires := server.calls("EXPIRE"); len(expires) != 2 || expires[1] != "EXPIRE users 60" {
+		t.Fatalf("expires %q", expires)
+	}
+	var ttl int64
+	server.data(func(store *rtestStore) { ttl = store.ttls["users"] })
+	if ttl != 60 {
+		t.Fatalf("ttl %d", ttl)
+	}
+	if _, err := dao.Update("default", "users", "z", "v", true, 0, nil); err == nil || !strings.Contains(err.Error(), "reached max fields 2") {
+		t.Fatalf("expect the write past maxfields refused, got %v", err)
+	}
+
+	// override drops the fields and the old settings
+	if ok, err := dao.UpdateGroup("default", "users", map[string]interface{}{"maxfields": 0}, true, true, nil); err != nil || ok != true {
+		t.Fatalf("override %v %v", ok, err)
+	}
+	server.data(func(store *rtestStore) { meta = store.hashes[GROUP_META_PREFIX+"users"] })
+	if meta["maxfields"] != "0" || meta["ttl"] != "" || meta["created"] == "" {
+		t.Fatalf("meta after override %v", meta)
+	}
+	if _, err := dao.Update("default", "users", "z", "v", true, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	var fields int
+	server.data(func(store *rtestStore) { fields = len(store.hashes["users"]) })
+	if fields != 1 {
+		t.Fatalf("%d fields after override", fields)
+	}
+}
+
+func TestRGroupLimitsMissingMeta(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+
+	if _, err := dao.Update("default", "free", "x", "v", true, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	// declared by another process, the missing meta was not cached
+	server.data(func(store *rtestStore) { store.hash(GROUP_META_PREFIX + "free")["maxfields"] = "1" })
+	if _, err := dao.Update("default", "free", "y", "v", true, 0, nil); err == nil {
+		t.Fatal("expect the write past maxfields refused")
+	}
+}
+
+func TestRGetDBAndGroup(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+	server.data(func(store *rtestStore) {
+		store.strs["s"] = "v"
+		store.ttls["s"] = 10
+	})
+
+	ret, err := dao.GetDB("default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info = ret.(map[string]interface{})
+	if info["name"] != "default" || info["index"] != 0 || info["keys"] != int64(2) || info["expires"] != int64(1) {
+		t.Fatalf("db %v", info)
+	}
+	if info["instance_memory"] != int64(1048576) || info["instance_memory_human"] != "1.00M" || info["memory"] != nil {
+		t.Fatalf("db memory %v", info)
+	}
+
+	if ret, err = dao.GetGroup("default", "none", nil); err != nil || ret != nil {
+		t.Fatalf("missing group %v %v", ret, err)
+	}
+	if _, err = dao.UpdateGroup("default", "g", map[string]interface{}{"ttl": 30}, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ret, err = dao.GetGroup("default", "g", nil); err != nil {
+		t.Fatal(err)
+	}
+	var group = ret.(map[string]interface{})
+	if group["name"] != "g" || group["db"] != "default" || group["fields"] != int64(1) || group["encoding"] != "listpack" ||
+		group["ttl"] != int64(30) || group["memory"] != int64(128) || group["meta"].(map[string]string)["ttl"] != "30" {
+		t.Fatalf("group %v", group)
+	}
+
+	// declared but not written yet
+	if _, err = dao.UpdateGroup("default", "empty", nil, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ret, err = dao.GetGroup("default", "empty", nil); err != nil {
+		t.Fatal(err)
+	}
+	group = ret.(map[string]interface{})
+	if group["fields"] != int64(0) || group["encoding"] != "" || group["ttl"] != int64(-2) || group["memory"] != int64(-1) {
+		t.Fatalf("empty group %v", group)
+	}
+}
+
+func TestRScan(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+	server.data(func(store *rtestStore) {
+		var h = store.hash("users")
+		for i := 0; i < 5; i++ {
+			h[fmt.Sprintf("u%d", i)] = fmt.Sprintf(`{"n":%d}`, i)
+		}
+	})
+
+	// pages of 2 until the cursor comes back as -1
+	var ids []string
+	var from = 0
+	for pages := 0; from >= 0; pages++ {
+		if pages > 5 {
+			t.Fatal("the cursor never ends")
+		}
+		rets, cursor, total, err := dao.Scan("default", "users", from, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 {
+			t.Fatalf("total %d", total)
+		}
+		for _, ret := range rets {
+			var m = ret.(map[string]interface{})
+			if m["id"] != fmt.Sprintf("u%v", m["n"]) {
+				t.Fatalf("record %v", m)
+			}
+			ids = append(ids, m["id"].(string))
+		}
+		from = cursor
+	}
+	if fmt.Sprint(ids) != "[u0 u1 u2 u3 u4]" {
+		t.Fatalf("scanned %v", ids)
+	}
+	var hscans = server.calls("HSCAN")
+	if hscans[0] != "HSCAN users 0 COUNT 2" || hscans[1] != "HSCAN users 2 COUNT 2" {
+		t.Fatalf("hscans %q", hscans)
+	}
+
+	// MATCH and COUNT from the query, COUNT overrides size
+	rets, cursor, _, err := dao.Scan("default", "users", 0, 2, 0, "MATCH", "u*", "COUNT", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hscans = server.calls("HSCAN"); hscans[len(hscans)-1] != "HSCAN users 0 MATCH u* COUNT 10" {
+		t.Fatalf("hscan %q", hscans[len(hscans)-1])
+	}
+	if cursor != -1 || len(rets) != 5 || rets[0] != `{"n":0}` {
+		t.Fatalf("scan %v cursor %d", rets, cursor)
+	}
+}
+
+func TestRScanKeys(t *testing.T) {
+	var server = newRTestServer(t, "a", "master")
+	defer server.listener.Close()
+	var dao = newRTestDao(t, server, map[string]interface{}{})
+	defer dao.Close()
+	server.data(func(store *rtestStore) {
+		store.strs["s"] = `{"n":1}`
+		store.hash(GROUP_META_PREFIX + "g")["ttl"] = "0"
+	})
+
+	// hashes come as maps, plain keys are read with GET, meta hashes are left out
+	rets, cursor, total, err := dao.Scan("default", "", 0, 10, 1, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != -1 || total != 3 || len(rets) != 2 {
+		t.Fatalf("scan %v cursor %d total %d", rets, cursor, total)
+	}
+	if fmt.Sprint(rets) != "[map[id:g] map[id:s n:1]]" {
+		t.Fatalf("scan %v", rets)
+	}
+	if scans := server.calls("SCAN"); scans[0] != "SCAN 0 MATCH * COUNT 10" {
+		t.Fatalf("scans %q", scans)
+	}
+}
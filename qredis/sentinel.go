@@ -0,0 +1,263 @@
+package qredis
+
+import (
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ============================ sentinel ========================== */
+
+var ErrSentinelFailover = errors.New("redis master changed, connection discarded")
+
+type RSentinel struct {
+	Addrs  []string
+	Master string
+	Pass   string
+
+	mutex    sync.Mutex
+	gen      uint64
+	dialopts []redis.DialOption
+}
+
+func NewRSentinel(addrs []string, master string, pass string, dialopts ...redis.DialOption) *RSentinel {
+	var s = &RSentinel{
+		Addrs:  addrs,
+		Master: master,
+		Pass:   pass,
+	}
+	s.dialopts = append(s.dialopts, dialopts...)
+	if len(pass) > 0 {
+		s.dialopts = append(s.dialopts, redis.DialPassword(pass))
+	}
+	return s
+}
+
+// do runs fn against the first reachable sentinel, which is then kept in front
+func (o *RSentinel) do(fn func(conn redis.Conn) error) error {
+	o.mutex.Lock()
+	var addrs = append([]string(nil), o.Addrs...)
+	o.mutex.Unlock()
+	if len(addrs) == 0 {
+		return errors.New("no sentinel address configured")
+	}
+	var lasterr error
+	for i, addr := range addrs {
+		conn, err := redis.Dial("tcp", addr, o.dialopts...)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		err = fn(conn)
+		conn.Close()
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		if i > 0 {
+			o.mutex.Lock()
+			for n, one := range o.Addrs {
+				if one == addr {
+					copy(o.Addrs[1:n+1], o.Addrs[:n])
+					o.Addrs[0] = addr
+					break
+				}
+			}
+			o.mutex.Unlock()
+		}
+		return nil
+	}
+	return fmt.Errorf("no sentinel available for %s: %v", o.Master, lasterr)
+}
+
+func (o *RSentinel) MasterAddr() (addr string, err error) {
+	err = o.do(func(conn redis.Conn) error {
+		var hostport, err = redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", o.Master))
+		if err != nil {
+			return err
+		}
+		if len(hostport) != 2 {
+			return fmt.Errorf("master %s unknown to sentinel", o.Master)
+		}
+		addr = net.JoinHostPort(hostport[0], hostport[1])
+		return nil
+	})
+	return addr, err
+}
+
+func (o *RSentinel) ReplicaAddrs() (addrs []string, err error) {
+	err = o.do(func(conn redis.Conn) error {
+		var replies, err = redis.Values(conn.Do("SENTINEL", "slaves", o.Master))
+		if err != nil {
+			return err
+		}
+		addrs = addrs[:0]
+		for _, reply := range replies {
+			var m, merr = redis.StringMap(reply, nil)
+			if merr != nil {
+				continue
+			}
+			if strings.Contains(m["flags"], "s_down") || strings.Contains(m["flags"], "o_down") || strings.Contains(m["flags"], "disconnected") {
+				continue
+			}
+			if m["master-link-status"] != "" && m["master-link-status"] != "ok" {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(m["ip"], m["port"]))
+		}
+		return nil
+	})
+	return addrs, err
+}
+
+func (o *RSentinel) generation() uint64 {
+	return atomic.LoadUint64(&o.gen)
+}
+
+// Failover invalidates every connection dialed before it
+func (o *RSentinel) Failover() {
+	atomic.AddUint64(&o.gen, 1)
+}
+
+// DialMaster resolves the current master and checks its role before handing out the connection
+func (o *RSentinel) DialMaster(dial func(addr string) (redis.Conn, error)) (redis.Conn, error) {
+	var gen = o.generation()
+	addr, err := o.MasterAddr()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err == nil && len(role) > 0 {
+		if srole, _ := redis.String(role[0], nil); srole != "master" {
+			err = fmt.Errorf("%s is %s, not master of %s", addr, srole, o.Master)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &rsentinelConn{Conn: conn, sentinel: o, gen: gen}, nil
+}
+
+// TestMaster is the TestOnBorrow of master pools: ROLE instead of PING, a connection to a demoted
+// master starts a failover instead of failing the command it was borrowed for
+func (o *RSentinel) TestMaster(conn redis.Conn, t time.Time) error {
+	if err := conn.Err(); err != nil {
+		return err
+	}
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) > 0 {
+		if srole, _ := redis.String(role[0], nil); srole != "master" {
+			o.Failover()
+			return fmt.Errorf("%s is no more master of %s", srole, o.Master)
+		}
+	}
+	return nil
+}
+
+// DialReplica connects to a random healthy replica, falling back to the master
+func (o *RSentinel) DialReplica(dial func(addr string) (redis.Conn, error)) (redis.Conn, error) {
+	var gen = o.generation()
+	addrs, err := o.ReplicaAddrs()
+	if err != nil || len(addrs) == 0 {
+		return o.DialMaster(dial)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	for _, addr := range addrs {
+		conn, err := dial(addr)
+		if err == nil {
+			return &rsentinelConn{Conn: conn, sentinel: o, gen: gen}, nil
+		}
+	}
+	return o.DialMaster(dial)
+}
+
+func isFailoverErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if rerr, ok := err.(redis.Error); ok {
+		var msg = string(rerr)
+		return strings.HasPrefix(msg, "READONLY") || strings.HasPrefix(msg, "MASTERDOWN")
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	// a slow command says nothing about the master
+	if nerr, ok := err.(net.Error); ok {
+		return !nerr.Timeout()
+	}
+	var msg = err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "connection reset")
+}
+
+// rsentinelConn drops out of the pool once a failover has been detected
+type rsentinelConn struct {
+	redis.Conn
+	sentinel *RSentinel
+	gen      uint64
+}
+
+func (c *rsentinelConn) check(err error) error {
+	if isFailoverErr(err) {
+		c.sentinel.Failover()
+	}
+	return err
+}
+
+func (c *rsentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	var reply, err = c.Conn.Do(cmd, args...)
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) Receive() (interface{}, error) {
+	var reply, err = c.Conn.Receive()
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	var reply, err = redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	var reply, err = redis.ReceiveWithTimeout(c.Conn, timeout)
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	var reply, err = redis.DoContext(c.Conn, ctx, cmd, args...)
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	var reply, err = redis.ReceiveContext(c.Conn, ctx)
+	return reply, c.check(err)
+}
+
+func (c *rsentinelConn) Err() error {
+	if err := c.Conn.Err(); err != nil {
+		return err
+	}
+	if c.sentinel.generation() != c.gen {
+		return ErrSentinelFailover
+	}
+	return nil
+}
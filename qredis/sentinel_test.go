@@ -0,0 +1,279 @@
+package qredis
+
+import (
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rtestServer stands in for a redis master or replica over an rtestStore holding the hash g
+// with field id set to the server name. writes are refused with READONLY unless master
+// and BLPOP never answers in time
+type rtestServer struct {
+	*standin
+	name  string
+	mutex sync.Mutex
+	role  string
+	store *rtestStore
+}
+
+func newRTestServer(t *testing.T, name string, role string) *rtestServer {
+	var s = &rtestServer{name: name, role: role, store: newRTestStore()}
+	s.store.hash("g")["id"] = name
+	s.store.readonly = role != "master"
+	s.standin = newTCPStandin(t, s.handle)
+	return s
+}
+
+func (s *rtestServer) handle(args []string, asking bool) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "ROLE":
+		return rtestArray(rtestBulk(s.role))
+	case "BLPOP":
+		time.Sleep(200 * time.Millisecond)
+		return "*-1\r\n"
+	}
+	return rtestReply(s.store.exec(args))
+}
+
+func (s *rtestServer) setRole(role string) {
+	s.mutex.Lock()
+	s.role = role
+	s.store.readonly = role != "master"
+	s.mutex.Unlock()
+}
+
+func (s *rtestServer) written() int {
+	return len(s.calls("HSET"))
+}
+
+// calls returns the commands named cmd the server ran
+func (s *rtestServer) calls(cmd string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store.calls(cmd)
+}
+
+// data runs fn on the keyspace of the server
+func (s *rtestServer) data(fn func(store *rtestStore)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn(s.store)
+}
+
+// rtestSentinel answers get-master-addr-by-name and slaves for mymaster
+type rtestSentinel struct {
+	*standin
+	mutex    sync.Mutex
+	master   string
+	replicas []map[string]string
+}
+
+func newRTestSentinel(t *testing.T, master string) *rtestSentinel {
+	var s = &rtestSentinel{master: master}
+	s.standin = newTCPStandin(t, s.handle)
+	return s
+}
+
+func (s *rtestSentinel) handle(args []string, asking bool) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if strings.ToUpper(args[0]) != "SENTINEL" || len(args) < 3 || args[2] != "mymaster" {
+		return "-ERR unknown command\r\n"
+	}
+	switch strings.ToLower(args[1]) {
+	case "get-master-addr-by-name":
+		var host, port, _ = net.SplitHostPort(s.master)
+		return rtestArray(rtestBulk(host), rtestBulk(port))
+	case "slaves":
+		var replicas []string
+		for _, replica := range s.replicas {
+			var fields []string
+			for k, v := range replica {
+				fields = append(fields, rtestBulk(k), rtestBulk(v))
+			}
+			replicas = append(replicas, rtestArray(fields...))
+		}
+		return rtestArray(replicas...)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (s *rtestSentinel) failover(master string) {
+	s.mutex.Lock()
+	s.master = master
+	s.mutex.Unlock()
+}
+
+func rtestReplica(addr string, flags string) map[string]string {
+	var host, port, _ = net.SplitHostPort(addr)
+	return map[string]string{"ip": host, "port": port, "flags": flags, "master-link-status": "ok"}
+}
+
+func rtestDial(addr string) (redis.Conn, error) {
+	return redis.Dial("tcp", addr)
+}
+
+func TestRSentinelMaster(t *testing.T) {
+	var a = newRTestServer(t, "a", "master")
+	var b = newRTestServer(t, "b", "slave")
+	defer a.listener.Close()
+	defer b.listener.Close()
+	var sentinel = newRTestSentinel(t, a.addr())
+	defer sentinel.listener.Close()
+
+	var rs = NewRSentinel([]string{"127.0.0.1:1", sentinel.addr()}, "mymaster", "")
+	addr, err := rs.MasterAddr()
+	if err != nil || addr != a.addr() {
+		t.Fatalf("master %s %v", addr, err)
+	}
+	// the sentinel that answered goes in front
+	if rs.Addrs[0] != sentinel.addr() {
+		t.Fatalf("sentinels %v", rs.Addrs)
+	}
+	conn, err := rs.DialMaster(rtestDial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// a sentinel lagging behind a failover must not hand out a replica
+	sentinel.failover(b.addr())
+	if _, err = rs.DialMaster(rtestDial); err == nil || !strings.Contains(err.Error(), "not master") {
+		t.Fatalf("expect role check failure, got %v", err)
+	}
+}
+
+func TestRSentinelFailover(t *testing.T) {
+	var a = newRTestServer(t, "a", "master")
+	var b = newRTestServer(t, "b", "slave")
+	defer a.listener.Close()
+	defer b.listener.Close()
+	var sentinel = newRTestSentinel(t, a.addr())
+	defer sentinel.listener.Close()
+
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "", 0, "", "", "0", map[string]interface{}{
+		"sentinels": sentinel.addr(),
+	})
+	// keep the connection to the old master around
+	dao.MaxIdle = 1
+	defer dao.Close()
+	if _, err := dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.Update("default", "g", "id", "v", true, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a.setRole("slave")
+	b.setRole("master")
+	sentinel.failover(b.addr())
+	// the idle connection to the old master is dropped on borrow, the write goes to the new one
+	if _, err := dao.Update("default", "g", "id", "v", true, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if a.written() != 1 || b.written() != 1 {
+		t.Fatalf("writes a %d b %d", a.written(), b.written())
+	}
+	// the other connections dialed before are refused on borrow by their Err
+	if dao.sentinel.generation() == 0 {
+		t.Fatal("the demoted master must start a failover")
+	}
+	var stale = &rsentinelConn{Conn: dao.pool.Get(), sentinel: dao.sentinel}
+	defer stale.Close()
+	if err := dao.pool.TestOnBorrow(stale, time.Now()); err != ErrSentinelFailover {
+		t.Fatalf("expect ErrSentinelFailover, got %v", err)
+	}
+}
+
+func TestRSentinelTimeout(t *testing.T) {
+	var a = newRTestServer(t, "a", "master")
+	defer a.listener.Close()
+	var sentinel = newRTestSentinel(t, a.addr())
+	defer sentinel.listener.Close()
+
+	var rs = NewRSentinel([]string{sentinel.addr()}, "mymaster", "")
+	conn, err := rs.DialMaster(rtestDial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = redis.DoWithTimeout(conn, 50*time.Millisecond, "BLPOP", "q", 0); err == nil {
+		t.Fatal("expect timeout")
+	}
+	if rs.generation() != 0 {
+		t.Fatal("a timeout is no failover")
+	}
+
+	var expects = map[error]bool{
+		redis.Error("READONLY You can't write against a read only replica."): true,
+		redis.Error("MASTERDOWN Link with MASTER is down"):                   true,
+		redis.Error("ERR wrong number of arguments"):                         false,
+		io.EOF: true,
+		errors.New("dial tcp: connection refused"):    true,
+		&net.OpError{Op: "read", Err: rtestTimeout{}}: false,
+	}
+	for err, expect := range expects {
+		if isFailoverErr(err) != expect {
+			t.Errorf("isFailoverErr(%v) expect %v", err, expect)
+		}
+	}
+}
+
+type rtestTimeout struct{}
+
+func (rtestTimeout) Error() string   { return "i/o timeout" }
+func (rtestTimeout) Timeout() bool   { return true }
+func (rtestTimeout) Temporary() bool { return true }
+
+func TestRSentinelReplica(t *testing.T) {
+	var a = newRTestServer(t, "a", "master")
+	var b = newRTestServer(t, "b", "slave")
+	var c = newRTestServer(t, "c", "slave")
+	defer a.listener.Close()
+	defer b.listener.Close()
+	defer c.listener.Close()
+	var sentinel = newRTestSentinel(t, a.addr())
+	defer sentinel.listener.Close()
+	sentinel.replicas = []map[string]string{
+		rtestReplica(b.addr(), "slave"),
+		rtestReplica(c.addr(), "slave,s_down"),
+	}
+
+	var dao = &DaoRedis{}
+	dao.Configure("test", "redis", "", 0, "", "", "0", map[string]interface{}{
+		"sentinels":    sentinel.addr(),
+		"read_replica": true,
+	})
+	defer dao.Close()
+	if _, err := dao.Conn(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if val, err := dao.Get("default", "g", "id", 0, nil); err != nil || val != "b" {
+			t.Fatalf("read from %v %v, expect the healthy replica", val, err)
+		}
+	}
+
+	// without a healthy replica reads go to the master
+	sentinel.mutex.Lock()
+	sentinel.replicas = sentinel.replicas[1:]
+	sentinel.mutex.Unlock()
+	var rs = NewRSentinel([]string{sentinel.addr()}, "mymaster", "")
+	conn, err := rs.DialReplica(rtestDial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if val, err := redis.String(conn.Do("HGET", "g", "id")); err != nil || val != "a" {
+		t.Fatalf("read from %v %v, expect the master", val, err)
+	}
+}
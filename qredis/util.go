@@ -1,9 +1,13 @@
 package qredis
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/camsiabor/qcom/qref"
+	"github.com/camsiabor/qcom/util"
+	"github.com/camsiabor/qdaobundle/internal/qtls"
 	"github.com/gomodule/redigo/redis"
 	"strings"
 )
@@ -63,6 +67,91 @@ func RParseScan(val interface{}, err error) (interface{}, error) {
 	return rets, nil
 }
 
+// RDo runs a command bound to ctx, cancelling ctx aborts the command and closes the connection
+func RDo(ctx context.Context, rclient redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoContext(rclient, ctx, cmd, args...)
+}
+
+// RReceive receives a pipelined reply bound to ctx
+func RReceive(ctx context.Context, rclient redis.Conn) (interface{}, error) {
+	return redis.ReceiveContext(rclient, ctx)
+}
+
+// RTLSConfig builds a client tls config from a CA bundle and an optional client certificate
+func RTLSConfig(cafile string, certfile string, keyfile string, servername string, skipverify bool) (*tls.Config, error) {
+	return qtls.Config(cafile, certfile, keyfile, servername, skipverify)
+}
+
+// RStrings accepts a comma separated string or a slice
+func RStrings(v interface{}) []string {
+	var ss []string
+	switch vv := v.(type) {
+	case string:
+		for _, one := range strings.Split(vv, ",") {
+			if one = strings.TrimSpace(one); len(one) > 0 {
+				ss = append(ss, one)
+			}
+		}
+	case []string:
+		ss = append(ss, vv...)
+	case []interface{}:
+		for _, one := range vv {
+			if sone := util.AsStr(one, ""); len(sone) > 0 {
+				ss = append(ss, sone)
+			}
+		}
+	}
+	return ss
+}
+
+// RScanArgs builds the cursor, MATCH and COUNT arguments of SCAN / HSCAN.
+// query is either a single match pattern, or raw MATCH / COUNT pairs
+func RScanArgs(from int, size int, query ...interface{}) redis.Args {
+	var args = redis.Args{}.Add(from)
+	var count = size
+	var qlen = len(query)
+	for i := 0; i < qlen; i++ {
+		var s, ok = query[i].(string)
+		if !ok || len(s) == 0 {
+			continue
+		}
+		switch strings.ToUpper(s) {
+		case "MATCH":
+			if i+1 < qlen {
+				args = args.Add("MATCH", query[i+1])
+				i++
+			}
+		case "COUNT":
+			if i+1 < qlen {
+				count = util.AsInt(query[i+1], count)
+				i++
+			}
+		default:
+			args = args.Add("MATCH", s)
+		}
+	}
+	if count > 0 {
+		args = args.Add("COUNT", count)
+	}
+	return args
+}
+
+// RParseInfo parses the reply of INFO into a field -> value map
+func RParseInfo(info string) map[string]string {
+	var m = make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var pair = strings.SplitN(line, ":", 2)
+		if len(pair) == 2 {
+			m[pair[0]] = pair[1]
+		}
+	}
+	return m
+}
+
 var _rparsers map[string]interface{}
 
 func RParse(cmd string, rawreply interface{}, err error) (interface{}, error) {